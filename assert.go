@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/antchfx/htmlquery"
+	"github.com/antchfx/xpath"
+	"golang.org/x/net/html"
+)
+
+// Assertion kinds, used to choose the ones failing as nagios warnings
+const (
+	assertKeyword         = "keyword"
+	assertNotKeyword      = "not_keyword"
+	assertRegex           = "regex"
+	assertNotRegex        = "not_regex"
+	assertStatus          = "status"
+	assertHeader          = "header"
+	assertForbiddenHeader = "forbidden_header"
+	assertMaxBodySize     = "max_body_size"
+	assertContentType     = "content_type"
+	assertCss             = "css"
+	assertXpath           = "xpath"
+)
+
+// Assertions on the main url response. All of them are checked,
+// failures are critical unless their kind is in Warning.
+type assertConfig struct {
+	Keywords         []string          `yaml:"keywords" toml:"keywords"`
+	NotKeywords      []string          `yaml:"not_keywords" toml:"not_keywords"`
+	Regex            []string          `yaml:"regex" toml:"regex"`
+	NotRegex         []string          `yaml:"not_regex" toml:"not_regex"`
+	Status           []string          `yaml:"status" toml:"status"`                       // 200, 2xx or 200-299
+	Headers          map[string]string `yaml:"headers" toml:"headers"`                     // value regex, any value if empty
+	ForbiddenHeaders map[string]string `yaml:"forbidden_headers" toml:"forbidden_headers"` // value regex, any value if empty
+	MaxBodySize      int               `yaml:"max_body_size" toml:"max_body_size"`
+	ContentType      string            `yaml:"content_type" toml:"content_type"`
+	Css              []string          `yaml:"css" toml:"css"`
+	Xpath            []string          `yaml:"xpath" toml:"xpath"`
+	Warning          []string          `yaml:"warning" toml:"warning"`
+}
+
+// A failed assertion
+type assertFailure struct {
+	kind    string
+	message string
+	status  int
+}
+
+// Build the assertions from the --assert-* flags, "Name: regex" for headers
+func parseAssertFlags(keywords, notKeywords, regex, notRegex, status, headers, forbiddenHeaders []string,
+	maxBodySize int, contentType string, css, xpath, warning []string) assertConfig {
+
+	parseHeaders := func(values []string) map[string]string {
+		if len(values) == 0 {
+			return nil
+		}
+		m := make(map[string]string)
+		for _, h := range values {
+			k, v, _ := cutHeader(h)
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		return m
+	}
+
+	return assertConfig{
+		Keywords:         keywords,
+		NotKeywords:      notKeywords,
+		Regex:            regex,
+		NotRegex:         notRegex,
+		Status:           status,
+		Headers:          parseHeaders(headers),
+		ForbiddenHeaders: parseHeaders(forbiddenHeaders),
+		MaxBodySize:      maxBodySize,
+		ContentType:      contentType,
+		Css:              css,
+		Xpath:            xpath,
+		Warning:          warning,
+	}
+}
+
+// Merge the assertions with the defaults: lists are added, values are kept
+func (a assertConfig) withDefaults(defaults *assertConfig) assertConfig {
+	concat := func(values []string, defaults []string) []string {
+		return append(append([]string(nil), defaults...), values...)
+	}
+	merge := func(values map[string]string, defaults map[string]string) map[string]string {
+		if values == nil && defaults == nil {
+			return nil
+		}
+		m := make(map[string]string)
+		for k, v := range defaults {
+			m[k] = v
+		}
+		for k, v := range values {
+			m[k] = v
+		}
+		return m
+	}
+
+	a.Keywords = concat(a.Keywords, defaults.Keywords)
+	a.NotKeywords = concat(a.NotKeywords, defaults.NotKeywords)
+	a.Regex = concat(a.Regex, defaults.Regex)
+	a.NotRegex = concat(a.NotRegex, defaults.NotRegex)
+	a.Css = concat(a.Css, defaults.Css)
+	a.Xpath = concat(a.Xpath, defaults.Xpath)
+	a.Warning = concat(a.Warning, defaults.Warning)
+	a.Headers = merge(a.Headers, defaults.Headers)
+	a.ForbiddenHeaders = merge(a.ForbiddenHeaders, defaults.ForbiddenHeaders)
+	if len(a.Status) == 0 {
+		a.Status = defaults.Status
+	}
+	if a.MaxBodySize == 0 {
+		a.MaxBodySize = defaults.MaxBodySize
+	}
+	if a.ContentType == "" {
+		a.ContentType = defaults.ContentType
+	}
+	return a
+}
+
+// Check that the assertions can be compiled
+func (a *assertConfig) validate() error {
+	for _, r := range append(append([]string(nil), a.Regex...), a.NotRegex...) {
+		if _, err := regexp.Compile(r); err != nil {
+			return fmt.Errorf("assert regex %s: %v", r, err)
+		}
+	}
+	for _, s := range a.Status {
+		if _, _, err := parseStatusRange(s); err != nil {
+			return err
+		}
+	}
+	for _, headers := range []map[string]string{a.Headers, a.ForbiddenHeaders} {
+		for k, v := range headers {
+			if _, err := regexp.Compile(v); err != nil {
+				return fmt.Errorf("assert header %s: %v", k, err)
+			}
+		}
+	}
+	for _, s := range a.Css {
+		if _, err := cascadia.Compile(s); err != nil {
+			return fmt.Errorf("assert css %s: %v", s, err)
+		}
+	}
+	for _, x := range a.Xpath {
+		if _, err := xpath.Compile(x); err != nil {
+			return fmt.Errorf("assert xpath %s: %v", x, err)
+		}
+	}
+	for _, kind := range a.Warning {
+		switch kind {
+		case assertKeyword, assertNotKeyword, assertRegex, assertNotRegex, assertStatus, assertHeader,
+			assertForbiddenHeader, assertMaxBodySize, assertContentType, assertCss, assertXpath:
+		default:
+			return fmt.Errorf("unknown assertion kind %s", kind)
+		}
+	}
+	return nil
+}
+
+// Parse a status code, a class like 2xx or a range like 200-299
+func parseStatusRange(s string) (int, int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		class := int(s[0]-'0') * 100
+		return class, class + 99, nil
+	}
+	if low, high, ok := strings.Cut(s, "-"); ok {
+		l, err1 := strconv.Atoi(strings.TrimSpace(low))
+		h, err2 := strconv.Atoi(strings.TrimSpace(high))
+		if err1 == nil && err2 == nil && l <= h {
+			return l, h, nil
+		}
+	} else if code, err := strconv.Atoi(s); err == nil {
+		return code, code, nil
+	}
+	return 0, 0, fmt.Errorf("bad assert status %s", s)
+}
+
+// Check the main url response, return all the failures
+func (a *assertConfig) check(stat *downloadStatistic, body []byte) []assertFailure {
+	var failures []assertFailure
+	fail := func(kind string, format string, args ...interface{}) {
+		status := NAGIOS_ERROR
+		for _, w := range a.Warning {
+			if w == kind {
+				status = NAGIOS_WARNING
+			}
+		}
+		failures = append(failures, assertFailure{kind: kind, message: fmt.Sprintf(format, args...), status: status})
+	}
+
+	if len(a.Status) > 0 {
+		matched := false
+		for _, s := range a.Status {
+			low, high, _ := parseStatusRange(s)
+			matched = matched || (stat.statusCode >= low && stat.statusCode <= high)
+		}
+		if !matched {
+			fail(assertStatus, "status %d is not %s", stat.statusCode, strings.Join(a.Status, ","))
+		}
+	}
+
+	for _, k := range a.Keywords {
+		if !bytes.Contains(body, []byte(k)) {
+			fail(assertKeyword, "keyword %q not found", k)
+		}
+	}
+	for _, k := range a.NotKeywords {
+		if bytes.Contains(body, []byte(k)) {
+			fail(assertNotKeyword, "keyword %q found", k)
+		}
+	}
+	for _, r := range a.Regex {
+		if re, err := regexp.Compile(r); err == nil && !re.Match(body) {
+			fail(assertRegex, "regex %s not matched", r)
+		}
+	}
+	for _, r := range a.NotRegex {
+		if re, err := regexp.Compile(r); err == nil && re.Match(body) {
+			fail(assertNotRegex, "regex %s matched", r)
+		}
+	}
+
+	for k, v := range a.Headers {
+		values := stat.responseHeader.Values(k)
+		if len(values) == 0 {
+			fail(assertHeader, "header %s missing", k)
+		} else if !headerMatches(values, v) {
+			fail(assertHeader, "header %s does not match %s", k, v)
+		}
+	}
+	for k, v := range a.ForbiddenHeaders {
+		if values := stat.responseHeader.Values(k); len(values) > 0 && headerMatches(values, v) {
+			fail(assertForbiddenHeader, "header %s: %s is forbidden", k, strings.Join(values, ", "))
+		}
+	}
+
+	if a.MaxBodySize > 0 && len(body) > a.MaxBodySize {
+		fail(assertMaxBodySize, "body size %d is over %d", len(body), a.MaxBodySize)
+	}
+
+	if a.ContentType != "" {
+		contentType, _, _ := mime.ParseMediaType(stat.responseHeader.Get("Content-Type"))
+		if !strings.EqualFold(contentType, a.ContentType) {
+			fail(assertContentType, "content type %q is not %s", contentType, a.ContentType)
+		}
+	}
+
+	if len(a.Css) > 0 || len(a.Xpath) > 0 {
+		doc, err := html.Parse(bytes.NewReader(body))
+		if err != nil {
+			doc = &html.Node{Type: html.DocumentNode}
+		}
+		for _, s := range a.Css {
+			if sel, err := cascadia.Compile(s); err == nil && sel.MatchFirst(doc) == nil {
+				fail(assertCss, "selector %s not found", s)
+			}
+		}
+		for _, x := range a.Xpath {
+			if node, err := htmlquery.Query(doc, x); err == nil && node == nil {
+				fail(assertXpath, "xpath %s not found", x)
+			}
+		}
+	}
+
+	return failures
+}
+
+// Check if a header value matches a regex, any value matches an empty one
+func headerMatches(values []string, pattern string) bool {
+	if pattern == "" {
+		return true
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Nagios status of the assertion failures
+func assertionsStatus(failures []assertFailure) int {
+	status := NAGIOS_OK
+	for _, f := range failures {
+		status = worseNagiosStatus(status, f.status)
+	}
+	return status
+}
+
+// Print the assertion failures
+func printAssertFailures(failures []assertFailure) {
+	for _, f := range failures {
+		if f.status == NAGIOS_WARNING {
+			fmt.Printf("%s %s.\n", red("Assertion warning:"), f.message)
+		} else {
+			fmt.Printf("%s %s.\n", red("Assertion failed:"), f.message)
+		}
+	}
+}
+
+// Join the assertion failure messages
+func formatAssertFailures(failures []assertFailure) string {
+	var messages []string
+	for _, f := range failures {
+		messages = append(messages, f.message)
+	}
+	return strings.Join(messages, ", ")
+}
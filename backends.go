@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// A page fetch against one backend of the target host
+type backendResult struct {
+	addr    string
+	result  *targetResult
+	hash    string // main url body hash, empty on error
+	differs bool   // hash differs from the most common one
+}
+
+// Json report of a backend fan-out
+type backendsReport struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	ElmoVersion   string           `json:"elmoVersion"`
+	Url           string           `json:"url"`
+	Status        string           `json:"status"`
+	Backends      []*backendReport `json:"backends"`
+}
+
+type backendReport struct {
+	Backend        string `json:"backend"`
+	Status         string `json:"status"`
+	ContentHash    string `json:"contentHash,omitempty"`
+	ContentDiffers bool   `json:"contentDiffers"`
+	*report
+}
+
+// Addresses of the target host: the --backend flags, else all its addresses
+// from the --resolve overrides or the DNS
+func targetBackends(target *targetConfig, backends []string) ([]string, error) {
+	if len(backends) > 0 {
+		addrs := make([]string, len(backends))
+		for i, b := range backends {
+			addrs[i] = strings.Trim(b, "[]")
+			if net.ParseIP(addrs[i]) == nil {
+				return nil, fmt.Errorf("backend %s is not an ip address", b)
+			}
+		}
+		return addrs, nil
+	}
+
+	host, port, err := urlHostPort(target.Url)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newHostResolver(target.Resolve, target.DnsServer, target.IpVersion)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return resolver.resolve(ctx, host, port)
+}
+
+// Host and port of an url, the port defaults to the scheme one
+func urlHostPort(rawUrl string) (string, string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return u.Hostname(), port, nil
+}
+
+// A copy of the target pinned to a backend, its har file is suffixed with the backend
+func backendTarget(target *targetConfig, addr string) (targetConfig, error) {
+	host, _, err := urlHostPort(target.Url)
+	if err != nil {
+		return targetConfig{}, err
+	}
+
+	t := *target
+	t.Name = addr
+	//the first matching override wins, on any port so a redirect
+	//from http to https stays on the backend
+	t.Resolve = append(stringList{host + ":*:[" + addr + "]"}, target.Resolve...)
+	if t.Har != "" {
+		ext := filepath.Ext(t.Har)
+		t.Har = strings.TrimSuffix(t.Har, ext) + "-" + strings.ReplaceAll(addr, ":", "_") + ext
+	}
+	return t, nil
+}
+
+// Fetch the page against each backend, one at a time or all in parallel
+func runBackends(target *targetConfig, addrs []string, parallel bool, influx *influxConfig,
+	stream func(target string, statType string, stat *downloadStatistic)) ([]*backendResult, error) {
+
+	targets := make([]targetConfig, len(addrs))
+	for i, addr := range addrs {
+		t, err := backendTarget(target, addr)
+		if err != nil {
+			return nil, err
+		}
+		targets[i] = t
+	}
+
+	maxConcurrent := 1
+	if parallel {
+		maxConcurrent = len(targets)
+	}
+	results := runTargets(targets, maxConcurrent, influx, stream)
+
+	backends := make([]*backendResult, len(results))
+	hashes := make(map[string]int)
+	for i, r := range results {
+		backends[i] = &backendResult{addr: addrs[i], result: r}
+		if r.page.err == nil {
+			sum := sha256.Sum256(r.page.body)
+			backends[i].hash = hex.EncodeToString(sum[:])
+			hashes[backends[i].hash]++
+		}
+	}
+
+	//the most common content is the reference
+	reference := ""
+	for hash, count := range hashes {
+		if count > hashes[reference] || (count == hashes[reference] && hash < reference) {
+			reference = hash
+		}
+	}
+	for _, b := range backends {
+		b.differs = b.hash != "" && b.hash != reference
+	}
+	return backends, nil
+}
+
+// Status of the fan-out: critical if at least criticalCount backends are, all of them if 0,
+// so one dead origin behind a load balancer is only a warning by default.
+// Warning if any is not OK or serves another content.
+func backendsStatus(backends []*backendResult, criticalCount int) int {
+	if criticalCount <= 0 || criticalCount > len(backends) {
+		criticalCount = len(backends)
+	}
+	critical, degraded := 0, false
+	for _, b := range backends {
+		if b.result.status == NAGIOS_ERROR {
+			critical++
+		}
+		degraded = degraded || b.result.status != NAGIOS_OK || b.differs
+	}
+	switch {
+	case len(backends) > 0 && critical >= criticalCount:
+		return NAGIOS_ERROR
+	case degraded:
+		return NAGIOS_WARNING
+	}
+	return NAGIOS_OK
+}
+
+// Print the comparison table of the backends
+func printBackendsTable(w io.Writer, backends []*backendResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Backend\tStatus\tMain\tTime\tSize\tAssets\tContent\t")
+	for _, b := range backends {
+		page := &b.result.page
+		if page.err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\t-\t%v\n", b.addr, nagiosStatusName(b.result.status), page.err)
+			continue
+		}
+		content := b.hash[:12]
+		if b.differs {
+			content += " differs"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%dkb\t%d/%d\t%s\t%s\n", b.addr, nagiosStatusName(b.result.status),
+			page.mainUrlStat.statusCode, page.gstat.totalResponseTime.Round(time.Millisecond),
+			page.gstat.totalResponseSize/1024, len(page.assetsStats), len(page.assets), content,
+			formatAssertFailures(page.failures))
+	}
+	tw.Flush()
+}
+
+// Print the nagios line of the fan-out, with the backends table as long output
+func printBackendsNagios(target *targetConfig, backends []*backendResult, status int) {
+	var problems, perfdata []string
+	for _, b := range backends {
+		page := &b.result.page
+		switch {
+		case page.err != nil:
+			problems = append(problems, fmt.Sprintf("%s %v", b.addr, page.err))
+		case b.result.status != NAGIOS_OK:
+			problems = append(problems, fmt.Sprintf("%s %s in %v", b.addr, nagiosStatusName(b.result.status), page.gstat.totalResponseTime))
+		case b.differs:
+			problems = append(problems, b.addr+" content differs")
+		}
+		if page.err == nil {
+			perfdata = append(perfdata,
+				fmt.Sprintf("'%s time'=%.3fms;%d;%d;0", b.addr, msec(page.gstat.totalResponseTime),
+					target.NagiosWarning, target.NagiosCritical),
+				fmt.Sprintf("'%s size'=%dKB", b.addr, page.gstat.totalResponseSize/1024))
+		}
+	}
+
+	summary := fmt.Sprintf("%d backends %s.", len(backends), nagiosStatusName(status))
+	if len(problems) > 0 {
+		summary = fmt.Sprintf("%d/%d backends degraded: %s.", len(problems), len(backends), strings.Join(problems, ", "))
+	}
+	fmt.Printf("%s|%s\n", summary, strings.Join(perfdata, " "))
+	printBackendsTable(os.Stdout, backends)
+}
+
+// Write the json report of the fan-out, in ndjson mode one summary line per backend
+func writeBackendsReport(w io.Writer, target *targetConfig, backends []*backendResult, status int) error {
+	br := backendsReport{
+		SchemaVersion: reportSchemaVersion,
+		ElmoVersion:   VERSION,
+		Url:           target.Url,
+		Status:        nagiosStatusName(status),
+	}
+	for _, b := range backends {
+		br.Backends = append(br.Backends, &backendReport{
+			Backend:        b.addr,
+			Status:         nagiosStatusName(b.result.status),
+			ContentHash:    b.hash,
+			ContentDiffers: b.differs,
+			report:         newReport(b.result.target, &b.result.page, b.result.repeatPage),
+		})
+	}
+
+	if outputFormat == outputNdjson {
+		for _, b := range br.Backends {
+			if err := writeReport(w, b.report); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(br)
+}
+
+// Fetch the --url page against each backend and compare them
+func checkBackends(c *cli.Context, target *targetConfig, influx *influxConfig) {
+	addrs, err := targetBackends(target, c.StringSlice("backend"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(NAGIOS_UNKNOWN)
+	}
+
+	//stream the statistics in ndjson mode
+	var stream func(target string, statType string, stat *downloadStatistic)
+	if outputFormat == outputNdjson && !useNagios {
+		var mu sync.Mutex
+		stream = func(target string, statType string, stat *downloadStatistic) {
+			mu.Lock()
+			defer mu.Unlock()
+			writeNdjsonStat(os.Stdout, target, statType, stat)
+		}
+	}
+
+	backends, err := runBackends(target, addrs, c.Bool("fan-out-parallel"), influx, stream)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(NAGIOS_UNKNOWN)
+	}
+	status := backendsStatus(backends, c.Int("fan-out-critical"))
+
+	if useNagios {
+		printBackendsNagios(target, backends, status)
+		os.Exit(status)
+	} else if !textOutput() {
+		writeBackendsReport(os.Stdout, target, backends, status)
+	} else {
+		printBackendsTable(os.Stdout, backends)
+		fmt.Printf("Backends status: %s.\n", nagiosStatusName(status))
+	}
+
+	if status != NAGIOS_OK {
+		os.Exit(1)
+	}
+}
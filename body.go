@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// Assertion kind of the assets aborted by --max-asset-size
+const assertMaxAssetSize = "max_asset_size"
+
+// Count, and optionally hash, the bytes of a body while it is streamed
+type bodyCounter struct {
+	n    int
+	hash hash.Hash
+}
+
+func newBodyCounter(hashed bool) *bodyCounter {
+	c := &bodyCounter{}
+	if hashed {
+		c.hash = sha256.New()
+	}
+	return c
+}
+
+func (c *bodyCounter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	if c.hash != nil {
+		c.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+// Hex sha256 of the body, empty if not hashed
+func (c *bodyCounter) sum() string {
+	if c.hash == nil {
+		return ""
+	}
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// Flag the assets aborted over the size limit as warnings
+func checkAssetSizes(page *pageResult, maxAssetSize int) []assertFailure {
+	var failures []assertFailure
+	for _, stat := range page.assetsStats {
+		if stat.oversized {
+			failures = append(failures, assertFailure{
+				kind:    assertMaxAssetSize,
+				message: fmt.Sprintf("%s aborted over %d bytes", stat.url, maxAssetSize),
+				status:  NAGIOS_WARNING,
+			})
+		}
+	}
+	return failures
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache status of a response
+const (
+	cacheHit         = "hit"
+	cacheRevalidated = "revalidated"
+)
+
+type cacheStatusKey struct{}
+
+// A cached response
+type cacheEntry struct {
+	statusCode int
+	proto      string
+	header     http.Header
+	body       []byte
+	storedAt   time.Time
+}
+
+// In memory private http cache, like a browser one.
+// It respects Cache-Control, Expires, ETag, Last-Modified and Vary.
+// The stored entries are never modified, a revalidation stores a new one.
+type httpCache struct {
+	transport http.RoundTripper
+
+	mu      sync.Mutex
+	vary    map[string][]string    // request headers the responses of an url vary on
+	entries map[string]*cacheEntry // by url and the values of its vary headers
+}
+
+func newHttpCache(transport http.RoundTripper) *httpCache {
+	return &httpCache{transport: transport, vary: make(map[string][]string), entries: make(map[string]*cacheEntry)}
+}
+
+// Ask the cache to report the cache status of a request
+func withCacheStatus(req *http.Request, status *string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheStatusKey{}, status))
+}
+
+func setCacheStatus(req *http.Request, status string) {
+	if s, ok := req.Context().Value(cacheStatusKey{}).(*string); ok {
+		*s = status
+	}
+}
+
+// Cache key of a request: its url and the values of the request headers
+// its responses vary on, like Accept-Encoding. The lock must be held.
+func (c *httpCache) key(req *http.Request) string {
+	key := req.URL.String()
+	for _, name := range c.vary[req.URL.String()] {
+		key += "\n" + name + ": " + strings.Join(req.Header.Values(name), ", ")
+	}
+	return key
+}
+
+// Store a response of a request
+func (c *httpCache) store(req *http.Request, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for _, name := range strings.Split(entry.header.Get("Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	c.vary[req.URL.String()] = names
+	c.entries[c.key(req)] = entry
+}
+
+func (c *httpCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return c.transport.RoundTrip(req)
+	}
+
+	c.mu.Lock()
+	entry := c.entries[c.key(req)]
+	c.mu.Unlock()
+
+	origReq := req
+	if entry != nil {
+		// fresh response, no network
+		if entry.isFresh() {
+			setCacheStatus(req, cacheHit)
+			return entry.response(req), nil
+		}
+
+		// stale response, revalidate it
+		if etag := entry.header.Get("ETag"); etag != "" || entry.header.Get("Last-Modified") != "" {
+			req = req.Clone(req.Context())
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified := entry.header.Get("Last-Modified"); lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		// store the response with the refreshed headers
+		refreshed := &cacheEntry{
+			statusCode: entry.statusCode,
+			proto:      entry.proto,
+			header:     entry.header.Clone(),
+			body:       entry.body,
+			storedAt:   time.Now(),
+		}
+		for k, v := range resp.Header {
+			refreshed.header[k] = v
+		}
+		c.store(origReq, refreshed)
+
+		setCacheStatus(req, cacheRevalidated)
+		return refreshed.response(req), nil
+	}
+
+	if isCacheable(resp) {
+		entry := &cacheEntry{
+			statusCode: resp.StatusCode,
+			proto:      resp.Proto,
+			header:     resp.Header.Clone(),
+		}
+		// store the body while the caller reads it
+		resp.Body = &cacheBody{ReadCloser: resp.Body, done: func(body []byte) {
+			entry.body = body
+			entry.storedAt = time.Now()
+			c.store(origReq, entry)
+		}}
+	}
+
+	return resp, nil
+}
+
+// Check if a response can be stored
+func isCacheable(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if _, ok := cacheControl(resp.Header)["no-store"]; ok {
+		return false
+	}
+	return resp.Header.Get("Vary") != "*"
+}
+
+// Parse the Cache-Control directives
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return directives
+}
+
+// Compute the freshness lifetime of a response:
+// max-age, then Expires, then 10% of the Last-Modified age like browsers do
+func freshnessLifetime(header http.Header) time.Duration {
+	cc := cacheControl(header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if maxAge, ok := cc["max-age"]; ok {
+		if seconds, err := strconv.Atoi(maxAge); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return t.Sub(date)
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		return date.Sub(lastModified) / 10
+	}
+
+	return 0
+}
+
+// Check if a stored response can be used without revalidation
+func (e *cacheEntry) isFresh() bool {
+	age := time.Since(e.storedAt)
+	if seconds, err := strconv.Atoi(e.header.Get("Age")); err == nil {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age < freshnessLifetime(e.header)
+}
+
+// Build a response from the cache
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(e.statusCode) + " " + http.StatusText(e.statusCode),
+		StatusCode:    e.statusCode,
+		Proto:         e.proto,
+		Header:        e.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// Body reader keeping a copy of the body for the cache
+type cacheBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func(body []byte)
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Assertion kind of the uncacheable share of the page with --audit-cache
+const assertUncacheable = "uncacheable"
+
+// Fingerprinted assets never change, they should be cached long.
+// Html documents change in place, they should not.
+const (
+	minFingerprintedTtl = 30 * 24 * time.Hour
+	maxHtmlTtl          = time.Hour
+)
+
+// Content hash in a file name, like app.3f2a9c1b.js or main-5d7e3a1f0b.css
+var fingerprintPattern = regexp.MustCompile(`(?i)[._-][0-9a-f]{8,}[._-]`)
+
+// Caching headers of a response and its effective ttl
+type cachePolicy struct {
+	cacheControl string
+	expires      string
+	etag         string
+	lastModified string
+	age          string
+	vary         string
+
+	ttl           time.Duration // freshness lifetime minus the Age, 0 if stale or not stored
+	storable      bool          // no no-store and no Vary: *
+	fingerprinted bool
+	html          bool
+}
+
+func newCachePolicy(stat *downloadStatistic) cachePolicy {
+	header := stat.responseHeader
+	if header == nil {
+		header = http.Header{}
+	}
+	p := cachePolicy{
+		cacheControl:  header.Get("Cache-Control"),
+		expires:       header.Get("Expires"),
+		etag:          header.Get("ETag"),
+		lastModified:  header.Get("Last-Modified"),
+		age:           header.Get("Age"),
+		vary:          header.Get("Vary"),
+		fingerprinted: isFingerprinted(stat.url),
+	}
+	if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+		p.html = mediaType == "text/html" || mediaType == "application/xhtml+xml"
+	}
+
+	_, noStore := cacheControl(header)["no-store"]
+	p.storable = !noStore && p.vary != "*"
+	if p.storable {
+		p.ttl = freshnessLifetime(header)
+		if seconds, err := strconv.Atoi(p.age); err == nil {
+			p.ttl -= time.Duration(seconds) * time.Second
+		}
+		if p.ttl < 0 {
+			p.ttl = 0
+		}
+	}
+	return p
+}
+
+// Check if the response is downloaded again on the next visit:
+// not stored, or stale without a validator to revalidate it
+func (p cachePolicy) uncacheable() bool {
+	return !p.storable || (p.ttl == 0 && p.etag == "" && p.lastModified == "")
+}
+
+// Check if an url is versioned by a content hash in its file name or a version parameter
+func isFingerprinted(assetUrl string) bool {
+	u, err := url.Parse(assetUrl)
+	if err != nil {
+		return false
+	}
+	if fingerprintPattern.MatchString(path.Base(u.Path)) {
+		return true
+	}
+	query := u.Query()
+	for _, key := range []string{"v", "ver", "version", "hash", "rev"} {
+		if query.Get(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// A caching issue of a response
+type cacheIssue struct {
+	url     string
+	message string
+	ttl     time.Duration
+}
+
+// Caching issues of the successful responses of a page,
+// with the uncacheable and total transferred sizes
+func auditCache(page *pageResult) (issues []cacheIssue, uncacheable int, total int) {
+	for i := range page.assetsStats {
+		stat := &page.assetsStats[i]
+		if stat.statusCode != http.StatusOK {
+			continue
+		}
+		p := newCachePolicy(stat)
+		total += stat.encodedSize
+		switch {
+		case p.uncacheable():
+			uncacheable += stat.encodedSize
+			issues = append(issues, cacheIssue{url: stat.url, message: "uncacheable"})
+		case p.fingerprinted && p.ttl < minFingerprintedTtl:
+			issues = append(issues, cacheIssue{url: stat.url, message: "fingerprinted with a short ttl", ttl: p.ttl})
+		case p.html && p.ttl > maxHtmlTtl:
+			issues = append(issues, cacheIssue{url: stat.url, message: "html with a long ttl", ttl: p.ttl})
+		}
+	}
+	return
+}
+
+// Flag a page with more than maxShare percent of its bytes uncacheable as a warning
+func checkCacheability(page *pageResult, maxShare int) []assertFailure {
+	_, uncacheable, total := auditCache(page)
+	if total == 0 || uncacheable*100 <= maxShare*total {
+		return nil
+	}
+	return []assertFailure{{
+		kind:    assertUncacheable,
+		message: fmt.Sprintf("%d%% of the page bytes are uncacheable, over %d%%", uncacheable*100/total, maxShare),
+		status:  NAGIOS_WARNING,
+	}}
+}
+
+// Format a ttl with its largest unit, like 30d or 5m
+func formatTtl(ttl time.Duration) string {
+	switch {
+	case ttl >= 24*time.Hour:
+		return fmt.Sprintf("%dd", ttl/(24*time.Hour))
+	case ttl >= time.Hour:
+		return fmt.Sprintf("%dh", ttl/time.Hour)
+	case ttl >= time.Minute:
+		return fmt.Sprintf("%dm", ttl/time.Minute)
+	}
+	return fmt.Sprintf("%ds", ttl/time.Second)
+}
+
+// Print the uncacheable share of the page and the caching issues
+func printCacheAudit(page *pageResult) {
+	issues, uncacheable, total := auditCache(page)
+	share := 0
+	if total > 0 {
+		share = uncacheable * 100 / total
+	}
+	fmt.Printf("Cache audit: %vkb of %vkb uncacheable (%d%%), %d issues.\n", uncacheable/1024, total/1024, share, len(issues))
+	for _, issue := range issues {
+		if issue.message == "uncacheable" {
+			fmt.Printf("\t%s %s\n", issue.url, issue.message)
+		} else {
+			fmt.Printf("\t%s %s of %s\n", issue.url, issue.message, formatTtl(issue.ttl))
+		}
+	}
+}
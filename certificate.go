@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Assertion kind of the certificate expiry checks
+const assertCertExpiry = "cert_expiry"
+
+// TLS connection state of a response
+type tlsInfo struct {
+	version      string
+	cipher       string
+	alpn         string // negotiated application protocol, like h2
+	ocspStapled  bool
+	certificates []certInfo // peer chain, leaf first
+}
+
+// A peer certificate
+type certInfo struct {
+	subject   string
+	issuer    string
+	sans      []string
+	notBefore time.Time
+	notAfter  time.Time
+	keyType   string
+}
+
+// Keep the TLS connection state of a response, nil for plain http
+func newTlsInfo(state *tls.ConnectionState) *tlsInfo {
+	if state == nil {
+		return nil
+	}
+
+	info := &tlsInfo{
+		version:     tls.VersionName(state.Version),
+		cipher:      tls.CipherSuiteName(state.CipherSuite),
+		alpn:        state.NegotiatedProtocol,
+		ocspStapled: len(state.OCSPResponse) > 0,
+	}
+	for _, cert := range state.PeerCertificates {
+		c := certInfo{
+			subject:   cert.Subject.String(),
+			issuer:    cert.Issuer.String(),
+			sans:      append([]string(nil), cert.DNSNames...),
+			notBefore: cert.NotBefore,
+			notAfter:  cert.NotAfter,
+			keyType:   publicKeyType(cert),
+		}
+		for _, ip := range cert.IPAddresses {
+			c.sans = append(c.sans, ip.String())
+		}
+		info.certificates = append(info.certificates, c)
+	}
+	return info
+}
+
+// Public key algorithm and size, like RSA-2048 or ECDSA-P256
+func publicKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA-" + strconv.Itoa(key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// Earliest expiry of a chain
+func (info *tlsInfo) earliestExpiry() (expiry time.Time) {
+	for _, cert := range info.certificates {
+		if expiry.IsZero() || cert.notAfter.Before(expiry) {
+			expiry = cert.notAfter
+		}
+	}
+	return
+}
+
+// TLS state of each https host of a page, from its first response
+func pageCertificates(page *pageResult) map[string]*tlsInfo {
+	hosts := make(map[string]*tlsInfo)
+	for _, stat := range page.assetsStats {
+		if stat.tls == nil || len(stat.tls.certificates) == 0 {
+			continue
+		}
+		u, err := url.Parse(stat.url)
+		if err != nil {
+			continue
+		}
+		if _, ok := hosts[u.Host]; !ok {
+			hosts[u.Host] = stat.tls
+		}
+	}
+	return hosts
+}
+
+// Check the certificates expiry of the main url and asset hosts,
+// thresholds are in days and disabled at 0
+func checkCertificates(page *pageResult, warningDays int, criticalDays int) []assertFailure {
+	if warningDays <= 0 && criticalDays <= 0 {
+		return nil
+	}
+
+	certs := pageCertificates(page)
+	hosts := make([]string, 0, len(certs))
+	for host := range certs {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var failures []assertFailure
+	for _, host := range hosts {
+		expiry := certs[host].earliestExpiry()
+		left := time.Until(expiry)
+		days := int(left.Hours() / 24)
+
+		status := NAGIOS_OK
+		if criticalDays > 0 && left < time.Duration(criticalDays)*24*time.Hour {
+			status = NAGIOS_ERROR
+		} else if warningDays > 0 && left < time.Duration(warningDays)*24*time.Hour {
+			status = NAGIOS_WARNING
+		}
+		if status == NAGIOS_OK {
+			continue
+		}
+
+		message := fmt.Sprintf("certificate of %s expires in %d days (%s)", host, days, expiry.Format("2006-01-02"))
+		if left <= 0 {
+			message = fmt.Sprintf("certificate of %s expired on %s", host, expiry.Format("2006-01-02"))
+		}
+		failures = append(failures, assertFailure{kind: assertCertExpiry, message: message, status: status})
+	}
+	return failures
+}
+
+// Print the certificate of the main url, and the asset hosts ones in verbose mode
+func printCertificates(page *pageResult) {
+	certs := pageCertificates(page)
+	if len(certs) == 0 {
+		return
+	}
+
+	printHost := func(host string, info *tlsInfo) {
+		leaf := info.certificates[0]
+		stapled := ""
+		if info.ocspStapled {
+			stapled = ", OCSP stapled"
+		}
+		expiry := info.earliestExpiry()
+		fmt.Printf("\t%s: %s %s, %s %s, expires %s (%d days)%s\n", host, info.version, info.cipher,
+			leaf.subject, leaf.keyType, expiry.Format("2006-01-02"), int(time.Until(expiry).Hours()/24), stapled)
+	}
+
+	mainHost := ""
+	if u, err := url.Parse(page.mainUrlStat.url); err == nil {
+		mainHost = u.Host
+	}
+	hosts := make([]string, 0, len(certs))
+	for host := range certs {
+		if host != mainHost {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	fmt.Println("Certificates:")
+	if info, ok := certs[mainHost]; ok {
+		printHost(mainHost, info)
+	}
+	if !verbose {
+		if len(hosts) > 0 {
+			fmt.Printf("\t%d asset hosts, listed in verbose mode\n", len(hosts))
+		}
+		return
+	}
+	for _, host := range hosts {
+		printHost(host, certs[host])
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// HTTP versions of the client, HTTP/2 is negotiated by default like browsers do
+const (
+	httpVersionAuto = ""
+	httpVersion1    = "1.1"
+	httpVersion2    = "2"
+	httpVersion3    = "3"
+)
+
+// Settings of the http client, timeouts are in ms
+type clientConfig struct {
+	connectTimeout        int
+	tlsTimeout            int
+	responseHeaderTimeout int
+	timeout               int
+	resolve               []string // host:port:addr[,addr...]
+	dnsServer             string
+	ipVersion             int
+	httpVersion           string
+	tls                   tlsClientConfig
+	proxy                 proxyConfig
+}
+
+// Client TLS settings
+type tlsClientConfig struct {
+	caFile         string
+	certFile       string // PEM, with keyFile
+	keyFile        string
+	pkcs12File     string
+	pkcs12Password string
+	serverName     string // SNI sent to sniHost instead of its name
+	sniHost        string
+	minVersion     string
+	maxVersion     string
+	ciphers        string // comma separated, TLS 1.2 and lower
+	insecure       bool
+}
+
+// Round tripper of a client, its connections are closed before a repeat view
+type clientTransport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// Build the http client and its transport
+func newHttpClient(config *clientConfig) (*http.Client, clientTransport, error) {
+
+	tlsConfig, err := newTlsConfig(&config.tls)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolver, err := newHostResolver(config.resolve, config.dnsServer, config.ipVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var transport clientTransport
+	switch config.httpVersion {
+	case httpVersionAuto, httpVersion1, httpVersion2:
+		proxy, err := newProxyFunc(&config.proxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		transport = newTcpTransport(config, tlsConfig, resolver, proxy)
+	case httpVersion3:
+		//QUIC does not go through the proxies, only the environment ones are ignored
+		if config.proxy.url != "" || config.proxy.pac != "" {
+			return nil, nil, errors.New("proxies are not supported with HTTP/3")
+		}
+		transport = newQuicTransport(config, tlsConfig, resolver)
+	default:
+		return nil, nil, errors.New("bad http version " + config.httpVersion)
+	}
+
+	//Set an http client with this transport
+	client := &http.Client{
+		Timeout:   time.Duration(config.timeout) * time.Millisecond,
+		Transport: transport,
+	}
+
+	return client, transport, nil
+}
+
+// Transport of HTTP/1.1 and HTTP/2 over TCP
+func newTcpTransport(config *clientConfig, tlsConfig *tls.Config, resolver *hostResolver,
+	proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+
+	//set timeouts
+	transport := &http.Transport{
+		TLSHandshakeTimeout:   time.Duration(config.tlsTimeout) * time.Millisecond,
+		ResponseHeaderTimeout: time.Duration(config.responseHeaderTimeout) * time.Millisecond,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     config.httpVersion != httpVersion1,
+		Proxy:                 proxy,
+	}
+	if config.httpVersion == httpVersion1 {
+		//a non nil empty map disables HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: time.Duration(config.connectTimeout) * time.Millisecond,
+		//        KeepAlive: 30 * time.Second,
+	}
+
+	transport.DialContext = resolver.dialContext(dialer)
+
+	//the server name is only overridden for its host and HTTP/2 is required
+	//by the ALPN offer, so the handshake is done here
+	if config.tls.serverName != "" || config.httpVersion == httpVersion2 {
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTls(ctx, transport, network, addr, &config.tls, config.httpVersion == httpVersion2)
+		}
+		//the transport does the handshake of the proxied connections without this dial,
+		//so these requests fail rather than silently ignoring the settings
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := proxy(req)
+			if u == nil || err != nil || req.URL.Scheme != "https" {
+				return u, err
+			}
+			if config.httpVersion == httpVersion2 {
+				return nil, errors.New("HTTP/2 only mode is not supported through a proxy")
+			}
+			if req.URL.Hostname() == config.tls.sniHost {
+				return nil, errors.New("the SNI override of " + config.tls.sniHost + " is not supported through a proxy")
+			}
+			return u, nil
+		}
+	}
+
+	return transport
+}
+
+// Transport of HTTP/3 over QUIC, which only runs on https urls
+func newQuicTransport(config *clientConfig, tlsConfig *tls.Config, resolver *hostResolver) *http3.Transport {
+	//QUIC sets up the connection and TLS in one handshake
+	handshakeTimeout := time.Duration(config.connectTimeout+config.tlsTimeout) * time.Millisecond
+
+	return &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig:      &quic.Config{HandshakeIdleTimeout: handshakeTimeout},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return dialQuic(ctx, resolver, addr, tlsCfg, cfg, &config.tls)
+		},
+	}
+}
+
+// Build the TLS configuration of the client
+func newTlsConfig(config *tlsClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.insecure}
+
+	if config.caFile != "" {
+		pem, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + config.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case config.pkcs12File != "":
+		data, err := ioutil.ReadFile(config.pkcs12File)
+		if err != nil {
+			return nil, err
+		}
+		key, cert, chain, err := pkcs12.DecodeChain(data, config.pkcs12Password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.pkcs12File, err)
+		}
+		certificate := tls.Certificate{PrivateKey: key, Leaf: cert, Certificate: [][]byte{cert.Raw}}
+		for _, c := range chain {
+			certificate.Certificate = append(certificate.Certificate, c.Raw)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	case config.certFile != "":
+		keyFile := config.keyFile
+		if keyFile == "" {
+			keyFile = config.certFile
+		}
+		certificate, err := tls.LoadX509KeyPair(config.certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	var err error
+	if tlsConfig.MinVersion, err = parseTlsVersion(config.minVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.MaxVersion, err = parseTlsVersion(config.maxVersion); err != nil {
+		return nil, err
+	}
+	if tlsConfig.CipherSuites, err = parseCipherSuites(config.ciphers); err != nil {
+		return nil, err
+	}
+
+	return tlsConfig, nil
+}
+
+// Parse a TLS version like 1.2, 0 if empty
+func parseTlsVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "1":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.New("bad tls version " + version)
+}
+
+// Parse a comma separated list of cipher suite names
+func parseCipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unknown cipher suite " + name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Dial a TLS connection, sending the overridden server name to its host,
+// with only HTTP/2 offered if required
+func dialTls(ctx context.Context, transport *http.Transport, network, addr string, config *tlsClientConfig, requireHttp2 bool) (net.Conn, error) {
+	conn, err := transport.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConfig := transport.TLSClientConfig.Clone()
+	tlsConfig.ServerName = host
+	if host == config.sniHost && config.serverName != "" {
+		tlsConfig.ServerName = config.serverName
+	}
+	if requireHttp2 {
+		tlsConfig.NextProtos = []string{"h2"}
+	}
+
+	if transport.TLSHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+		defer cancel()
+	}
+
+	//the transport only traces its own handshakes
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	err = tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err == nil && requireHttp2 && tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		err = fmt.Errorf("%s does not support HTTP/2", host)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Dial a QUIC connection to the first address of a host,
+// traced like the TCP ones
+func dialQuic(ctx context.Context, resolver *hostResolver, addr string, tlsConfig *tls.Config, quicConfig *quic.Config, config *tlsClientConfig) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == config.sniHost && config.serverName != "" {
+		tlsConfig.ServerName = config.serverName
+	}
+
+	addrs, err := resolver.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", host)
+	}
+	udpAddr := net.JoinHostPort(addrs[0], port)
+
+	//UDP has no connection setup, the QUIC handshake is only counted as the TLS one
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart("udp", udpAddr)
+	}
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone("udp", udpAddr, nil)
+	}
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	conn, err := quic.DialAddrEarly(ctx, udpAddr, tlsConfig, quicConfig)
+	var state tls.ConnectionState
+	if err == nil {
+		//wait for the handshake so it is measured
+		select {
+		case <-conn.HandshakeComplete():
+			state = conn.ConnectionState().TLS
+		case <-conn.Context().Done():
+			conn, err = nil, context.Cause(conn.Context())
+		case <-ctx.Done():
+			conn.CloseWithError(0, "")
+			conn, err = nil, ctx.Err()
+		}
+	}
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(state, err)
+	}
+	return conn, err
+}
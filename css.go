@@ -0,0 +1,59 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	cssCommentRegexp = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssImportRegexp  = regexp.MustCompile(`@import\s+(?:"([^"]*)"|'([^']*)')`)
+	cssUrlRegexp     = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+)
+
+// Extract the assets referenced by a stylesheet: @import rules, url() values and @font-face sources.
+// Relative urls are resolved against the stylesheet url.
+func extractCssAssets(css string, resolver *linkResolver) []string {
+	var assets []string
+
+	css = cssCommentRegexp.ReplaceAllString(css, "")
+
+	var links []string
+	for _, m := range cssImportRegexp.FindAllStringSubmatch(css, -1) {
+		links = append(links, m[1]+m[2])
+	}
+	for _, m := range cssUrlRegexp.FindAllStringSubmatch(css, -1) {
+		links = append(links, m[1]+m[2]+m[3])
+	}
+
+	for _, link := range links {
+		// skip references to svg elements
+		if strings.HasPrefix(strings.TrimSpace(link), "#") {
+			continue
+		}
+
+		assetUrl, err := resolver.resolve(link)
+		if err != nil || assetUrl == "" {
+			continue
+		}
+		assets = append(assets, assetUrl)
+	}
+
+	return assets
+}
+
+// Check if a response is a stylesheet
+func isStylesheet(resp *http.Response) bool {
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		return mediaType == "text/css"
+	}
+	return strings.HasSuffix(resp.Request.URL.Path, ".css")
+}
+
+// Check if a response is a html or xhtml document
+func isHtml(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
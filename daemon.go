@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// A daemon check result
+type historyEntry struct {
+	time   time.Time
+	gstat  globalStatistic
+	status int
+	err    error
+}
+
+// Rolling history of the check results by target
+type history struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string][]historyEntry
+}
+
+func newHistory(size int) *history {
+	return &history{size: size, entries: make(map[string][]historyEntry)}
+}
+
+// Add a result, the oldest one is dropped when the history is full
+func (h *history) add(target string, entry historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := append(h.entries[target], entry)
+	if len(entries) > h.size {
+		entries = entries[len(entries)-h.size:]
+	}
+	h.entries[target] = entries
+}
+
+// Copy of the results of a target, oldest first
+func (h *history) get(target string) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]historyEntry(nil), h.entries[target]...)
+}
+
+// Average page fetch time of the successful results of a target
+func (h *history) averageResponseTime(target string) (avg time.Duration, count int) {
+	var total time.Duration
+	for _, entry := range h.get(target) {
+		if entry.err == nil {
+			total += entry.gstat.totalResponseTime
+			count++
+		}
+	}
+	if count > 0 {
+		avg = total / time.Duration(count)
+	}
+	return
+}
+
+// Json form of a history entry
+type reportHistoryEntry struct {
+	Time         time.Time `json:"time"`
+	Status       string    `json:"status"`
+	ResponseTime float64   `json:"responseTimeMs"`
+	ResponseSize int       `json:"responseSize"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Write the history of all the targets as json
+func (h *history) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	targets := make(map[string][]reportHistoryEntry)
+	for target, entries := range h.entries {
+		for _, entry := range entries {
+			e := reportHistoryEntry{
+				Time:         entry.time,
+				Status:       nagiosStatusName(entry.status),
+				ResponseTime: msec(entry.gstat.totalResponseTime),
+				ResponseSize: entry.gstat.totalResponseSize,
+			}
+			if entry.err != nil {
+				e.Error = entry.err.Error()
+			}
+			targets[target] = append(targets[target], e)
+		}
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
+
+// Daemon settings and state
+type daemon struct {
+	interval time.Duration
+	jitter   time.Duration
+	influx   *influxConfig
+	history  *history
+}
+
+func daemonCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "daemon",
+		Usage: "Check the --url or the --config targets on intervals, reload the configuration on SIGHUP",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "interval",
+				Value: time.Minute,
+				Usage: "Default interval between two checks of a target",
+			},
+			&cli.DurationFlag{
+				Name:  "jitter",
+				Value: 5 * time.Second,
+				Usage: "Maximum random delay added to each interval",
+			},
+			&cli.IntFlag{
+				Name:  "history",
+				Value: 100,
+				Usage: "Count of results kept in memory by target",
+			},
+			&cli.StringFlag{
+				Name:  "listen-address",
+				Usage: "Address to serve the history as json on /history, disabled if empty",
+			},
+		},
+		Action: runDaemon,
+	}
+}
+
+// Load the daemon targets from the configuration file or the --url flag
+func loadDaemonTargets(c *cli.Context) ([]targetConfig, int, error) {
+	if c.String("config") != "" {
+		file, err := loadFileConfig(c.String("config"))
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(file.Targets) > 0 {
+			targets := fileTargets(c, file)
+			for _, target := range targets {
+				if target.Interval != "" {
+					interval, err := time.ParseDuration(target.Interval)
+					if err != nil {
+						return nil, 0, fmt.Errorf("target %s: bad interval %v", target.Name, err)
+					}
+					if interval <= 0 {
+						return nil, 0, fmt.Errorf("target %s: interval %s is not positive", target.Name, target.Interval)
+					}
+				}
+			}
+			//the PAC files are loaded on each reload, not on each check
+			if err := loadTargetsPac(targets); err != nil {
+				return nil, 0, err
+			}
+			return targets, file.MaxConcurrentTargets, nil
+		}
+	}
+
+	if c.String("url") == "" {
+		return nil, 0, fmt.Errorf("Required flag \"url\" or \"config\" not set")
+	}
+	target := flagsTargetConfig(c)
+	target.Name = target.Url
+	targets := []targetConfig{target}
+	if err := loadTargetsPac(targets); err != nil {
+		return nil, 0, err
+	}
+	return targets, 1, nil
+}
+
+// Run the daemon until SIGINT or SIGTERM
+func runDaemon(c *cli.Context) error {
+	targets, maxConcurrent, err := loadDaemonTargets(c)
+	if err != nil {
+		fmt.Println(red("Fatal:"), err)
+		os.Exit(1)
+	}
+
+	influx, err := flagsInfluxConfig(c)
+	if err != nil {
+		fmt.Println(red("Fatal:"), err)
+		os.Exit(1)
+	}
+
+	if c.Duration("interval") <= 0 {
+		fmt.Println(red("Fatal:"), "--interval must be positive")
+		os.Exit(1)
+	}
+	if c.Int("history") < 1 {
+		fmt.Println(red("Fatal:"), "--history must be at least 1")
+		os.Exit(1)
+	}
+
+	d := &daemon{
+		interval: c.Duration("interval"),
+		jitter:   c.Duration("jitter"),
+		influx:   influx,
+		history:  newHistory(c.Int("history")),
+	}
+
+	if c.String("listen-address") != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/history", d.history)
+		go func() {
+			if err := http.ListenAndServe(c.String("listen-address"), mux); err != nil {
+				fmt.Println(red("Fatal:"), err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		fmt.Fprintf(logOutput(), "%s checking %d targets\n", time.Now().Format(time.RFC3339), len(targets))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var schedulers sync.WaitGroup
+		budget := make(chan struct{}, maxConcurrent)
+		for i := range targets {
+			schedulers.Add(1)
+			go func(target *targetConfig) {
+				defer schedulers.Done()
+				d.schedule(ctx, target, budget)
+			}(&targets[i])
+		}
+
+		sig := <-signals
+		cancel()
+
+		//the schedulers return once their in-flight check is done
+		fmt.Fprintf(logOutput(), "%s %v, waiting for the running checks\n", time.Now().Format(time.RFC3339), sig)
+		schedulers.Wait()
+
+		if sig != syscall.SIGHUP {
+			return nil
+		}
+
+		//reload the configuration, keep the previous one on error
+		newTargets, newMaxConcurrent, err := loadDaemonTargets(c)
+		if err != nil {
+			fmt.Fprintln(logOutput(), red("Error:"), "reload", err)
+			continue
+		}
+		targets, maxConcurrent = newTargets, newMaxConcurrent
+	}
+}
+
+// Check a target on its interval until the context is canceled
+func (d *daemon) schedule(ctx context.Context, target *targetConfig, budget chan struct{}) {
+	interval := d.interval
+	if target.Interval != "" {
+		interval, _ = time.ParseDuration(target.Interval)
+	}
+
+	//spread the first checks
+	timer := time.NewTimer(d.randomJitter())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case budget <- struct{}{}:
+		}
+		start := time.Now()
+		result := runTarget(target, d.influx, nil)
+		<-budget
+
+		d.history.add(target.Name, historyEntry{
+			time:   start,
+			gstat:  result.page.gstat,
+			status: result.status,
+			err:    result.page.err,
+		})
+		d.printResult(result)
+
+		timer.Reset(interval + d.randomJitter())
+	}
+}
+
+func (d *daemon) randomJitter() time.Duration {
+	if d.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d.jitter)))
+}
+
+// Print a check result, with the average time of the history in text mode
+func (d *daemon) printResult(result *targetResult) {
+	if !textOutput() {
+		writeReport(os.Stdout, newReport(result.target, &result.page, result.repeatPage))
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	if result.page.err != nil {
+		fmt.Printf("%s %s %s %v\n", now, result.target.Name, red(nagiosStatusName(result.status)), result.page.err)
+		return
+	}
+
+	status := green(nagiosStatusName(result.status))
+	if result.status != NAGIOS_OK {
+		status = red(nagiosStatusName(result.status))
+	}
+
+	page := &result.page
+	avg, count := d.history.averageResponseTime(result.target.Name)
+	fmt.Printf("%s %s %s %d/%d assets %v%s in %v (avg %v over %d checks)\n",
+		now, result.target.Name, status,
+		len(page.assetsStats), len(page.assets), white(page.gstat.totalResponseSize/1024), white("kb"),
+		cyan(page.gstat.totalResponseTime), avg, count)
+}
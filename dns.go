@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Host name resolution of the client: the --resolve overrides first,
+// then the DNS server or the system resolver
+type hostResolver struct {
+	overrides []*resolveOverride
+	server    *dnsServer // nil for the system resolver
+	ipVersion int        // 4 or 6 to force the address family, 0 for both
+}
+
+// A --resolve override, like curl: host:port:addr[,addr...]
+type resolveOverride struct {
+	host  string // exact, * or *.domain
+	port  string // * for any
+	addrs []string
+	next  uint32 // round-robin index of the next connection
+}
+
+// A DNS record of an answer
+type dnsRecord struct {
+	name  string
+	rtype string
+	ttl   uint32
+	data  string
+}
+
+// DNS resolution of a request host
+type dnsInfo struct {
+	server  string // system for the system resolver, override for a --resolve
+	addrs   []string
+	records []dnsRecord // answers of the DNS server, with their TTL
+}
+
+// Parse the --resolve overrides and the DNS server
+func newHostResolver(resolve []string, server string, ipVersion int) (*hostResolver, error) {
+	r := &hostResolver{ipVersion: ipVersion}
+	switch ipVersion {
+	case 0, 4, 6:
+	default:
+		return nil, fmt.Errorf("bad ip version %d", ipVersion)
+	}
+
+	for _, s := range resolve {
+		override, err := parseResolveOverride(s)
+		if err != nil {
+			return nil, err
+		}
+		r.overrides = append(r.overrides, override)
+	}
+
+	if server != "" {
+		var err error
+		if r.server, err = parseDnsServer(server); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Parse host:port:addr[,addr...], the IPv6 addresses are in brackets, the host one too
+func parseResolveOverride(s string) (*resolveOverride, error) {
+	var parts []string
+	if strings.HasPrefix(s, "[") {
+		if end := strings.Index(s, "]:"); end != -1 {
+			parts = append([]string{s[1:end]}, strings.SplitN(s[end+2:], ":", 2)...)
+		}
+	} else {
+		parts = strings.SplitN(s, ":", 3)
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("bad resolve %s, expected host:port:addr", s)
+	}
+
+	override := &resolveOverride{host: strings.ToLower(parts[0]), port: parts[1]}
+	for _, addr := range strings.Split(parts[2], ",") {
+		addr = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(addr), "["), "]")
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("bad resolve %s, %s is not an ip address", s, addr)
+		}
+		override.addrs = append(override.addrs, addr)
+	}
+	return override, nil
+}
+
+// Check if an override applies to a host and port
+func (o *resolveOverride) match(host, port string) bool {
+	if o.port != "*" && o.port != port {
+		return false
+	}
+	host = strings.ToLower(host)
+	switch {
+	case o.host == "*":
+		return true
+	case strings.HasPrefix(o.host, "*."):
+		return strings.HasSuffix(host, o.host[1:])
+	}
+	return o.host == host
+}
+
+// First override matching a host and port, nil if none
+func (r *hostResolver) findOverride(host, port string) *resolveOverride {
+	for _, o := range r.overrides {
+		if o.match(host, port) {
+			return o
+		}
+	}
+	return nil
+}
+
+// Addresses of an override, rotated for each new connection
+func (o *resolveOverride) rotate() []string {
+	start := int(atomic.AddUint32(&o.next, 1)-1) % len(o.addrs)
+	return append(append([]string(nil), o.addrs[start:]...), o.addrs[:start]...)
+}
+
+// Network of a dial, restricted to the forced address family
+func (r *hostResolver) network(network string) string {
+	if r.ipVersion != 0 && (network == "tcp" || network == "udp") {
+		return network + fmt.Sprint(r.ipVersion)
+	}
+	return network
+}
+
+// Addresses of a host:port to dial, in order
+func (r *hostResolver) resolve(ctx context.Context, host, port string) ([]string, error) {
+	if o := r.findOverride(host, port); o != nil {
+		addrs := o.rotate()
+		if debug {
+			fmt.Printf(bold_white("debug: rewrite %s to %s\n"), net.JoinHostPort(host, port), strings.Join(addrs, ","))
+		}
+		recordDns(ctx, &dnsInfo{server: "override", addrs: addrs})
+		return addrs, nil
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if r.server == nil {
+		//the system resolver reports the DNS phase to the trace itself
+		ips, err := net.DefaultResolver.LookupIP(ctx, r.network("ip"), host)
+		if err != nil {
+			return nil, err
+		}
+		var addrs []string
+		for _, ip := range ips {
+			addrs = append(addrs, ip.String())
+		}
+		return addrs, nil
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	info, err := r.server.lookup(ctx, host, r.ipVersion)
+	if trace != nil && trace.DNSDone != nil {
+		done := httptrace.DNSDoneInfo{Err: err}
+		if info != nil {
+			for _, addr := range info.addrs {
+				done.Addrs = append(done.Addrs, net.IPAddr{IP: net.ParseIP(addr)})
+			}
+		}
+		trace.DNSDone(done)
+	}
+	if err != nil {
+		return nil, err
+	}
+	recordDns(ctx, info)
+	return info.addrs, nil
+}
+
+// Dial a host:port, trying its addresses in order
+func (r *hostResolver) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		network = r.network(network)
+
+		//the dialer resolves with the system resolver itself
+		if r.server == nil && r.findOverride(host, port) == nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		addrs, err := r.resolve(ctx, host, port)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// Keep the DNS resolution in the timer of the request
+func recordDns(ctx context.Context, info *dnsInfo) {
+	if p, ok := ctx.Value(phaseTimerKey{}).(*phaseTimer); ok {
+		p.setDns(info)
+	}
+}
+
+// A DNS server, over udp, tcp, tls (DoT) or https (DoH)
+type dnsServer struct {
+	scheme string
+	addr   string // host:port, or the url for https
+	client *http.Client
+}
+
+// Parse a DNS server: 1.1.1.1, udp://1.1.1.1:53, tcp://, tls://1.1.1.1:853
+// or https://cloudflare-dns.com/dns-query
+func parseDnsServer(s string) (*dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad dns server %s: %v", s, err)
+	}
+
+	server := &dnsServer{scheme: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			server.addr = net.JoinHostPort(u.Hostname(), "53")
+		}
+	case "tls":
+		if u.Port() == "" {
+			server.addr = net.JoinHostPort(u.Hostname(), "853")
+		}
+	case "https":
+		server.addr = u.String()
+		server.client = &http.Client{Timeout: 10 * time.Second}
+	default:
+		return nil, errors.New("unsupported dns server scheme " + u.Scheme)
+	}
+	return server, nil
+}
+
+func (s *dnsServer) String() string {
+	if s.scheme == "https" {
+		return s.addr
+	}
+	return s.scheme + "://" + s.addr
+}
+
+// Query the A and AAAA records of a host, following the CNAME records of the answers
+func (s *dnsServer) lookup(ctx context.Context, host string, ipVersion int) (*dnsInfo, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var types []dnsmessage.Type
+	if ipVersion != 6 {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if ipVersion != 4 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+
+	info := &dnsInfo{server: s.String()}
+	var lastErr error
+	for _, qtype := range types {
+		records, addrs, err := s.query(ctx, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		info.records = append(info.records, records...)
+		info.addrs = append(info.addrs, addrs...)
+	}
+	if len(info.addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no address found for %s on %s", host, s)
+		}
+		return nil, lastErr
+	}
+	return info, nil
+}
+
+// Send a query and parse the answers
+func (s *dnsServer) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsRecord, []string, error) {
+	//an unpredictable id makes the answers harder to spoof
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	answer, err := s.exchange(ctx, s.scheme, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(answer); err != nil {
+		return nil, nil, err
+	}
+	//a truncated udp answer is asked again over tcp
+	if msg.Truncated && s.scheme == "udp" {
+		if answer, err = s.exchange(ctx, "tcp", query); err != nil {
+			return nil, nil, err
+		}
+		if err := msg.Unpack(answer); err != nil {
+			return nil, nil, err
+		}
+	}
+	if msg.ID != id && s.scheme != "https" {
+		return nil, nil, errors.New("dns answer id mismatch")
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, nil, fmt.Errorf("dns lookup of %s on %s: %v", name, s, msg.RCode)
+	}
+
+	var records []dnsRecord
+	var addrs []string
+	for _, rr := range msg.Answers {
+		record := dnsRecord{
+			name:  strings.TrimSuffix(rr.Header.Name.String(), "."),
+			rtype: strings.TrimPrefix(rr.Header.Type.String(), "Type"),
+			ttl:   rr.Header.TTL,
+		}
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			record.data = net.IP(body.A[:]).String()
+			addrs = append(addrs, record.data)
+		case *dnsmessage.AAAAResource:
+			record.data = net.IP(body.AAAA[:]).String()
+			addrs = append(addrs, record.data)
+		case *dnsmessage.CNAMEResource:
+			record.data = strings.TrimSuffix(body.CNAME.String(), ".")
+		default:
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, addrs, nil
+}
+
+// Exchange a packed message with the server
+func (s *dnsServer) exchange(ctx context.Context, scheme string, query []byte) ([]byte, error) {
+	//the exchange is not traced as part of the request, but it stops with it
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	parent := ctx
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	defer context.AfterFunc(parent, cancel)()
+
+	if scheme == "https" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.addr, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set("Accept", "application/dns-message")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("dns server %s: status %d", s.addr, resp.StatusCode)
+		}
+		return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+	}
+
+	var dialer net.Dialer
+	network := scheme
+	if scheme == "tls" {
+		network = "tcp"
+	}
+	conn, err := dialer.DialContext(ctx, network, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	//the reads do not watch the context
+	defer context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })()
+	if scheme == "tls" {
+		host, _, _ := net.SplitHostPort(s.addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	if scheme == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, 65535)
+		n, err := conn.Read(answer)
+		if err != nil {
+			return nil, err
+		}
+		return answer[:n], nil
+	}
+
+	//stream transports prefix the messages with their length
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, length)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
@@ -16,13 +16,34 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/mreiferson/go-httpclient"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/dns/dnsmessage"
 
-	//	"net/url"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -182,3 +203,1690 @@ func TestCheckIfDomainAllowed(t *testing.T) {
 		}
 	}
 }
+
+func TestPhaseTimer(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "<html></html>")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{}
+
+	_, stat, err := fetchMainUrl(ts.URL, client, make(map[string]string), "")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if stat.ttfb < 20*time.Millisecond {
+		t.Errorf("ttfb should be at least 20ms but is %v", stat.ttfb)
+	}
+	if stat.connectTime <= 0 {
+		t.Errorf("connectTime should be set but is %v", stat.connectTime)
+	}
+	if stat.connReused {
+		t.Errorf("first connection should not be reused")
+	}
+
+	//second call on the same client reuse the connection
+	_, stat, _ = fetchMainUrl(ts.URL, client, make(map[string]string), "")
+	if !stat.connReused {
+		t.Errorf("second connection should be reused")
+	}
+}
+
+func TestBuildHar(t *testing.T) {
+
+	header := http.Header{"Content-Type": []string{"text/html"}}
+	assetsStats := []downloadStatistic{
+		{url: "http://test.com/?q=1", statusCode: 200, responseSize: 10, proto: "HTTP/1.1",
+			ttfb: 10 * time.Millisecond, connectTime: 5 * time.Millisecond,
+			remoteAddr: "127.0.0.1:80", responseHeader: header},
+		{url: "http://test.com/1.png", statusCode: 200, responseSize: 1, proto: "HTTP/1.1",
+			connReused: true, responseHeader: http.Header{}},
+	}
+	failedStats := []downloadStatistic{
+		{url: "http://test.com/2.png", statusCode: 200, err: fmt.Errorf("unexpected EOF")},
+	}
+	gstat := globalStatistic{totalResponseTime: 100 * time.Millisecond, totalResponseSize: 11}
+
+	h := buildHar(assetsStats, failedStats, gstat)
+
+	if h.Log.Version != "1.2" {
+		t.Errorf("har version should be 1.2 but is %s", h.Log.Version)
+	}
+	if len(h.Log.Entries) != 3 {
+		t.Fatalf("har should have 3 entries but has %d", len(h.Log.Entries))
+	}
+	if h.Log.Pages[0].PageTimings.OnLoad != 100 {
+		t.Errorf("har onLoad should be 100 but is %v", h.Log.Pages[0].PageTimings.OnLoad)
+	}
+
+	main := h.Log.Entries[0]
+	if main.Time != 15 {
+		t.Errorf("main entry time should be 15 but is %v", main.Time)
+	}
+	if main.ServerIPAddress != "127.0.0.1" {
+		t.Errorf("main entry serverIPAddress should be 127.0.0.1 but is %s", main.ServerIPAddress)
+	}
+	if main.Response.Content.MimeType != "text/html" {
+		t.Errorf("main entry mimeType should be text/html but is %s", main.Response.Content.MimeType)
+	}
+	if len(main.Request.QueryString) != 1 {
+		t.Errorf("main entry should have 1 query string parameter but has %d", len(main.Request.QueryString))
+	}
+	if h.Log.Entries[1].Timings.Connect != -1 {
+		t.Errorf("reused connection should have connect timing -1 but has %v", h.Log.Entries[1].Timings.Connect)
+	}
+	if failed := h.Log.Entries[2]; failed.Response.Status != 0 || failed.Error != "unexpected EOF" {
+		t.Errorf("failed entry should have status 0 and its error but has %d %q", failed.Response.Status, failed.Error)
+	}
+}
+
+func TestNewReportStat(t *testing.T) {
+
+	stat := downloadStatistic{url: "http://test.com/1.png", responseTime: 1500 * time.Microsecond,
+		ttfb: 2 * time.Millisecond, err: fmt.Errorf("timeout")}
+
+	r := newReportStat(&stat)
+
+	if r.ResponseTime != 1.5 {
+		t.Errorf("responseTimeMs should be 1.5 but is %v", r.ResponseTime)
+	}
+	if r.Timings.Ttfb != 2 {
+		t.Errorf("ttfbMs should be 2 but is %v", r.Timings.Ttfb)
+	}
+	if r.Error != "timeout" {
+		t.Errorf("error should be timeout but is %s", r.Error)
+	}
+	if r.StartTime != nil {
+		t.Errorf("startTime should be omitted but is %v", r.StartTime)
+	}
+}
+
+func TestParseSrcset(t *testing.T) {
+
+	tests := []struct {
+		srcset     string
+		candidates []srcsetCandidate
+	}{
+		{"a.png", []srcsetCandidate{{"a.png", 0, 0}}},
+		{"a.png 1x, b.png 2x", []srcsetCandidate{{"a.png", 0, 1}, {"b.png", 0, 2}}},
+		{" a.png 320w,b.png 640w ", []srcsetCandidate{{"a.png", 320, 0}, {"b.png", 640, 0}}},
+		{"a.png, b.png 2x", []srcsetCandidate{{"a.png", 0, 0}, {"b.png", 0, 2}}},
+		{"a,b.png 2x", []srcsetCandidate{{"a,b.png", 0, 2}}},
+	}
+
+	for _, tt := range tests {
+		candidates := parseSrcset(tt.srcset)
+		if fmt.Sprint(candidates) != fmt.Sprint(tt.candidates) {
+			t.Errorf("parseSrcset(%q) should return %v but returned %v", tt.srcset, tt.candidates, candidates)
+		}
+	}
+}
+
+func TestExtractMediaAssets(t *testing.T) {
+
+	const htmlBody = `<body>
+		<img src="small.png" srcset="medium.png 2x, large.png 3x">
+		<img srcset="w320.png 320w, w640.png 640w, w1280.png 1280w" sizes="(max-width: 600px) 100vw, 50vw">
+		<picture>
+			<source media="(min-width: 1000px)" srcset="desktop.webp">
+			<source media="(min-width: 500px)" srcset="tablet.webp 1x, tablet-2x.webp 2x">
+			<img src="fallback.png">
+		</picture>
+		<video poster="poster.jpg">
+			<source src="movie.webm"><source src="movie.mp4">
+			<track src="subs.vtt" default><track src="other.vtt">
+		</video>
+		<audio src="sound.mp3"></audio>
+	</body>`
+
+	tests := []struct {
+		viewport viewport
+		assets   []string
+	}{
+		{viewport{0, 1}, []string{"small.png", "medium.png", "large.png", "w320.png", "w640.png", "w1280.png",
+			"desktop.webp", "tablet.webp", "tablet-2x.webp", "fallback.png",
+			"poster.jpg", "movie.webm", "movie.mp4", "subs.vtt", "other.vtt", "sound.mp3"}},
+		{viewport{800, 2}, []string{"medium.png", "w1280.png", "tablet-2x.webp",
+			"poster.jpg", "movie.webm", "subs.vtt", "sound.mp3"}},
+		{viewport{400, 1}, []string{"small.png", "w640.png", "fallback.png",
+			"poster.jpg", "movie.webm", "subs.vtt", "sound.mp3"}},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://test.com/", nil)
+		req = withViewport(req, tt.viewport)
+		body := []byte(htmlBody)
+		assets, _ := extractAssets(&body, req)
+
+		var expected []string
+		for _, a := range tt.assets {
+			expected = append(expected, "http://test.com/"+a)
+		}
+		if fmt.Sprint(assets) != fmt.Sprint(expected) {
+			t.Errorf("viewport %d@%vx should extract %v but extracted %v", tt.viewport.width, tt.viewport.dpr, expected, assets)
+		}
+	}
+}
+
+func TestExtractCssAssets(t *testing.T) {
+
+	const css = `@import "reset.css";
+		@import url('theme/dark.css') screen;
+		/* url(commented.png) */
+		@font-face { font-family: x; src: url(../fonts/x.woff2) format("woff2"), url("/fonts/x.woff") format("woff"); }
+		.logo { background: url( "img/logo.png" ) no-repeat, url(data:image/png;base64,AAAA); }`
+
+	base, _ := url.Parse("http://test.com/css/main.css")
+	assets := extractCssAssets(css, newLinkResolver(base))
+
+	expected := []string{
+		"http://test.com/css/reset.css",
+		"http://test.com/css/theme/dark.css",
+		"http://test.com/fonts/x.woff2",
+		"http://test.com/fonts/x.woff",
+		"http://test.com/css/img/logo.png",
+	}
+	if fmt.Sprint(assets) != fmt.Sprint(expected) {
+		t.Errorf("extractCssAssets should return %v but returned %v", expected, assets)
+	}
+}
+
+func TestExtractInlineStyleAssets(t *testing.T) {
+
+	const htmlBody = `<head><style>body { background: url(bg.png) }</style></head>
+		<body><section style="background-image: url('section.png')"></section>
+		<span style="color: red"></span></body>`
+
+	req, _ := http.NewRequest("GET", "http://test.com/page/", nil)
+	body := []byte(htmlBody)
+	assets, _ := extractAssets(&body, req)
+
+	expected := []string{"http://test.com/page/bg.png", "http://test.com/page/section.png"}
+	if fmt.Sprint(assets) != fmt.Sprint(expected) {
+		t.Errorf("extractAssets should return %v but returned %v", expected, assets)
+	}
+}
+
+func TestExtractAssetsResolution(t *testing.T) {
+
+	const htmlBody = `<head><base href="/static/"></head><body>
+		<img src="httpdocs/x.png">
+		<script src="//cdn.test.com/x.js"></script>
+		<img src="https://other.com/y.png#frag">
+		<img src="data:image/png;base64,AAAA">
+		<img src="data:image/gif;base64,AAAA">
+		<script src="javascript:void(0)"></script>
+		<link rel="stylesheet" href="blob:https://test.com/1234">
+		<img src="">
+	</body>`
+
+	req, _ := http.NewRequest("GET", "https://test.com/page/index.html", nil)
+	body := []byte(htmlBody)
+	assets, skipped := extractAssets(&body, req)
+
+	expected := []string{
+		"https://test.com/static/httpdocs/x.png",
+		"https://cdn.test.com/x.js",
+		"https://other.com/y.png",
+	}
+	if fmt.Sprint(assets) != fmt.Sprint(expected) {
+		t.Errorf("extractAssets should return %v but returned %v", expected, assets)
+	}
+
+	expectedSkipped := map[string]int{"data": 2, "javascript": 1, "blob": 1}
+	if fmt.Sprint(skipped) != fmt.Sprint(expectedSkipped) {
+		t.Errorf("extractAssets should skip %v but skipped %v", expectedSkipped, skipped)
+	}
+}
+
+func TestNormalizeUrl(t *testing.T) {
+
+	tests := []struct {
+		url, normalized string
+	}{
+		{"HTTP://Test.COM", "http://test.com/"},
+		{"https://test.com:443/a.js#x", "https://test.com/a.js"},
+		{"http://test.com:8080/a.js?v=1", "http://test.com:8080/a.js?v=1"},
+		{"http://[::1]:80/a.js", "http://[::1]/a.js"},
+	}
+
+	for _, tt := range tests {
+		if normalized := normalizeUrl(tt.url); normalized != tt.normalized {
+			t.Errorf("normalizeUrl(%s) should return %s but returned %s", tt.url, tt.normalized, normalized)
+		}
+	}
+}
+
+func TestFetchPageDedupAndCache(t *testing.T) {
+
+	const htmlBody = `<body>
+		<script src="/1.js"></script><script src="/1.js"></script>
+		<img src="/etag.png"><img src="/etag.png"><img src="/nocache.png"><link rel="stylesheet" href="/a.css">
+	</body>`
+
+	var requests = make(map[string]int)
+	var mu sync.Mutex
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, htmlBody)
+		case "/1.js":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			fmt.Fprint(w, "js")
+		case "/etag.png":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, "png")
+		case "/nocache.png":
+			w.Header().Set("Cache-Control", "no-store")
+			fmt.Fprint(w, "png")
+		case "/a.css":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "text/css")
+			fmt.Fprint(w, `@import "b.css";`)
+		case "/b.css":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "text/css")
+			fmt.Fprint(w, `@import "a.css";`)
+		case "/vary.js":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Vary", "Accept-Encoding")
+			fmt.Fprint(w, r.Header.Get("Accept-Encoding"))
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: newHttpCache(http.DefaultTransport)}
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8}
+
+	page := fetchPage(config, client, nil)
+	if len(page.assets) != 5 {
+		t.Errorf("first view should fetch 5 assets but fetched %d", len(page.assets))
+	}
+	if countDuplicates(page.duplicates) != 2 {
+		t.Errorf("first view should find 2 duplicates but found %d", countDuplicates(page.duplicates))
+	}
+	if page.loops[ts.URL+"/a.css"] != 1 {
+		t.Errorf("the import loop should be reported apart from the duplicates, got %v", page.loops)
+	}
+
+	repeat := fetchPage(config, client, nil)
+	status := make(map[string]string)
+	for _, stat := range repeat.assetsStats {
+		status[stat.url] = stat.cacheStatus
+		if stat.cacheStatus != "" && stat.encodedSize != 0 {
+			t.Errorf("%s served by the cache should not be transferred, got %d bytes", stat.url, stat.encodedSize)
+		}
+	}
+
+	expected := map[string]string{
+		ts.URL + "/":            "",
+		ts.URL + "/1.js":        cacheHit,
+		ts.URL + "/etag.png":    cacheRevalidated,
+		ts.URL + "/nocache.png": "",
+		ts.URL + "/a.css":       "",
+		ts.URL + "/b.css":       "",
+	}
+	if fmt.Sprint(status) != fmt.Sprint(expected) {
+		t.Errorf("repeat view cache status should be %v but is %v", expected, status)
+	}
+	if requests["/1.js"] != 1 {
+		t.Errorf("/1.js should be requested once but was requested %d times", requests["/1.js"])
+	}
+
+	//the duplicates are revalidated at the same time
+	config.noDedup = true
+	fetchPage(config, client, nil)
+
+	//a response varying on Accept-Encoding is stored for each encoding
+	for _, tt := range []struct{ encoding, cacheStatus string }{{"gzip", ""}, {"br", ""}, {"gzip", cacheHit}} {
+		var cacheStatus string
+		req, _ := http.NewRequest("GET", ts.URL+"/vary.js", nil)
+		req.Header.Set("Accept-Encoding", tt.encoding)
+		resp, err := client.Do(withCacheStatus(req, &cacheStatus))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != tt.encoding || cacheStatus != tt.cacheStatus {
+			t.Errorf("vary.js for %s should be %q from the cache status %q, got %q with %q", tt.encoding, tt.encoding, tt.cacheStatus, body, cacheStatus)
+		}
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html>hello<img src="/1.png"><img src="/1.png"></html>`)
+		case "/1.png":
+			fmt.Fprint(w, "\x00")
+		}
+	}))
+	defer ts.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	config := &serveConfig{Modules: map[string]moduleConfig{
+		"default": {Parallel: 8, Timeout: 1000, ConnectTimeout: 1000, TlsTimeout: 1000},
+		"keyword": {Parallel: 8, Timeout: 1000, ConnectTimeout: 1000, TlsTimeout: 1000, Keyword: "missing"},
+		"hello":   {Parallel: 8, Timeout: 1000, ConnectTimeout: 1000, TlsTimeout: 1000, Keyword: "hello"},
+		"nodedup": {Parallel: 8, Timeout: 1000, ConnectTimeout: 1000, TlsTimeout: 1000, NoDedup: true},
+	}}
+
+	tests := []struct {
+		query   string
+		code    int
+		metrics []string
+	}{
+		{"", http.StatusBadRequest, nil},
+		{"?target=" + ts.URL + "/&module=unknown", http.StatusBadRequest, nil},
+		{"?target=" + ts.URL + "/", http.StatusOK, []string{
+			"probe_success 1", "probe_http_status_code 200", `elmo_assets{state="downloaded"} 1`}},
+		{"?target=" + ts.URL + "/&module=keyword", http.StatusOK, []string{
+			"probe_success 0", "elmo_keyword_match 0"}},
+		{"?target=" + ts.URL + "/&module=hello", http.StatusOK, []string{
+			"probe_success 1", "elmo_keyword_match 1"}},
+		//the keyword does not match a page which can not be fetched
+		{"?target=" + down.URL + "/&module=hello", http.StatusOK, []string{
+			"probe_success 0", "elmo_keyword_match 0"}},
+		{"?target=" + ts.URL + "/&module=nodedup", http.StatusOK, []string{
+			`elmo_assets{state="downloaded"} 2`}},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/probe"+tt.query, nil)
+		w := httptest.NewRecorder()
+		probeHandler(w, req, config)
+
+		if w.Code != tt.code {
+			t.Errorf("probe%s should return %d but returned %d", tt.query, tt.code, w.Code)
+		}
+		for _, m := range tt.metrics {
+			if !strings.Contains(w.Body.String(), m+"\n") {
+				t.Errorf("probe%s should return metric %s", tt.query, m)
+			}
+		}
+	}
+}
+
+func TestLinePointFormat(t *testing.T) {
+
+	p := linePoint{
+		tags: map[string]string{"main_url": "http://test.com/a b", "host": "", "type": "main"},
+		fields: map[string]interface{}{
+			"url":          `http://test.com/"x"`,
+			"statusCode":   200,
+			"responseTime": 5 * time.Millisecond,
+			"connReused":   true,
+		},
+		time: time.Unix(1, 0),
+	}
+
+	expected := `elmo,main_url=http://test.com/a\ b,type=main connReused=true,responseTime=5000000i,statusCode=200i,url="http://test.com/\"x\"" 1000000000` + "\n"
+	if line := p.format("elmo"); line != expected {
+		t.Errorf("linePoint.format should return %s but returned %s", expected, line)
+	}
+
+	//a failed main url is written with its error
+	stat := downloadStatistic{url: "http://test.com/", err: fmt.Errorf("connection refused")}
+	page := pageResult{mainUrlStat: stat, assetsStats: []downloadStatistic{stat}, err: stat.err}
+	points := pagePoints(&page, nil)
+	if len(points) != 2 {
+		t.Fatalf("a failed page should have 2 points but has %d", len(points))
+	}
+	for _, p := range points {
+		if p.fields["error"] != "connection refused" || p.tags["status_class"] != "error" {
+			t.Errorf("the %s point should have the error, has %v %v", p.tags["type"], p.fields, p.tags)
+		}
+	}
+}
+
+func TestParseInfluxTags(t *testing.T) {
+
+	tags, err := parseInfluxTags([]string{"env=prod", "dc=par=1"})
+	if err != nil || tags["env"] != "prod" || tags["dc"] != "par=1" {
+		t.Errorf("parseInfluxTags returned %v, %v", tags, err)
+	}
+
+	if _, err := parseInfluxTags([]string{"env"}); err == nil {
+		t.Errorf("parseInfluxTags should fail without value")
+	}
+}
+
+func TestLoadFileConfig(t *testing.T) {
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"targets.yml": `
+max_concurrent_targets: 2
+defaults:
+  parallel: 4
+  nagios_warning: 1000
+  headers:
+    X-Test: "1"
+targets:
+  - name: home
+    url: http://test.com/
+    keyword: elmo
+    headers:
+      X-Other: "2"
+  - url: http://test.com/shop
+    parallel: 2
+    viewport_width: 800
+modules:
+  fast:
+    timeout: 500
+`,
+		"targets.toml": `
+max_concurrent_targets = 2
+[defaults]
+parallel = 4
+nagios_warning = 1000
+[defaults.headers]
+X-Test = "1"
+[[targets]]
+name = "home"
+url = "http://test.com/"
+keyword = "elmo"
+[targets.headers]
+X-Other = "2"
+[[targets]]
+url = "http://test.com/shop"
+parallel = 2
+viewport_width = 800
+[modules.fast]
+timeout = 500
+`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+
+		config, err := loadFileConfig(path)
+		if err != nil {
+			t.Fatalf("loadFileConfig(%s) returned %v", name, err)
+		}
+		if config.MaxConcurrentTargets != 2 || len(config.Targets) != 2 || config.Modules["fast"].Timeout != 500 {
+			t.Fatalf("loadFileConfig(%s) returned %+v", name, config)
+		}
+
+		flags := targetConfig{moduleConfig: moduleConfig{Timeout: 10000, Parallel: 8}, NagiosCritical: 10000, Har: "/tmp/elmo.har"}
+		defaults := config.Defaults.withDefaults(&flags)
+		home := config.Targets[0].withDefaults(&defaults)
+		shop := config.Targets[1].withDefaults(&defaults)
+
+		if home.Keyword != "elmo" || home.Parallel != 4 || home.Timeout != 10000 ||
+			home.NagiosWarning != 1000 || home.NagiosCritical != 10000 {
+			t.Errorf("%s: home target should use the defaults, got %+v", name, home)
+		}
+		if home.Headers["X-Test"] != "1" || home.Headers["X-Other"] != "2" {
+			t.Errorf("%s: home target headers should be merged, got %v", name, home.Headers)
+		}
+		if shop.Name != "http://test.com/shop" || shop.Parallel != 2 {
+			t.Errorf("%s: shop target should be named by its url and keep its parallel, got %+v", name, shop)
+		}
+		if home.Har != "/tmp/elmo-home.har" || shop.Har != "/tmp/elmo-http___test.com_shop.har" {
+			t.Errorf("%s: targets should not share the default har, got %s and %s", name, home.Har, shop.Har)
+		}
+		if home.viewport() != (viewport{0, 1}) || shop.viewport() != (viewport{800, 1}) {
+			t.Errorf("%s: shop target should have its own viewport, got %v and %v", name, home.viewport(), shop.viewport())
+		}
+		if report := newReportConfig(&shop); report.ViewportWidth != 800 || report.DevicePixelRatio != 1 {
+			t.Errorf("%s: shop report should have the target viewport, got %+v", name, report)
+		}
+	}
+
+	path := filepath.Join(dir, "nourl.yml")
+	os.WriteFile(path, []byte("targets:\n  - name: home\n"), 0644)
+	if _, err := loadFileConfig(path); err == nil {
+		t.Errorf("loadFileConfig should fail on a target without url")
+	}
+
+	path = filepath.Join(dir, "samehar.yml")
+	os.WriteFile(path, []byte("targets:\n  - url: http://test.com/\n    har: /tmp/elmo.har\n  - url: http://test.com/shop\n    har: /tmp/elmo.har\n"), 0644)
+	if _, err := loadFileConfig(path); err == nil {
+		t.Errorf("loadFileConfig should fail on targets writing the same har")
+	}
+}
+
+func TestNagiosStatus(t *testing.T) {
+
+	tests := []struct {
+		duration time.Duration
+		status   int
+	}{
+		{500 * time.Millisecond, NAGIOS_OK},
+		{time.Second, NAGIOS_WARNING},
+		{3 * time.Second, NAGIOS_ERROR},
+	}
+	for _, tt := range tests {
+		if status := nagiosStatus(tt.duration, 1000, 2000); status != tt.status {
+			t.Errorf("nagiosStatus(%v) should return %d but returned %d", tt.duration, tt.status, status)
+		}
+	}
+
+	results := []*targetResult{{status: NAGIOS_OK}, {status: NAGIOS_UNKNOWN}, {status: NAGIOS_WARNING}}
+	if status := worstNagiosStatus(results); status != NAGIOS_WARNING {
+		t.Errorf("worstNagiosStatus should return %d but returned %d", NAGIOS_WARNING, status)
+	}
+}
+
+func TestHistory(t *testing.T) {
+
+	h := newHistory(2)
+	for _, ms := range []int{10, 20, 40} {
+		h.add("home", historyEntry{gstat: globalStatistic{totalResponseTime: time.Duration(ms) * time.Millisecond}})
+	}
+	h.add("home", historyEntry{err: fmt.Errorf("timeout")})
+
+	if entries := h.get("home"); len(entries) != 2 || entries[0].gstat.totalResponseTime != 40*time.Millisecond {
+		t.Errorf("history should keep the last 2 results, got %v", entries)
+	}
+	if avg, count := h.averageResponseTime("home"); avg != 40*time.Millisecond || count != 1 {
+		t.Errorf("averageResponseTime should return 40ms over 1 check but returned %v over %d", avg, count)
+	}
+	if entries := h.get("shop"); len(entries) != 0 {
+		t.Errorf("history of an unknown target should be empty, got %v", entries)
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprint(w, `<html><form><input type="hidden" name="csrf" value="tok123"></form></html>`)
+			return
+		}
+		r.ParseForm()
+		if r.Form.Get("csrf") != "tok123" || r.Form.Get("user") != "bob" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `<html><h1 class="name">Welcome bob</h1><a class="order" href="/api?id=7">order</a></html>`)
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"order": {"id": %s, "items": [{"sku": "A1"}]}}`, r.URL.Query().Get("id"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	scenario := &scenarioConfig{
+		Name:      "login",
+		Variables: map[string]string{"user": "bob"},
+		Steps: []scenarioStep{
+			{Name: "form", Url: ts.URL + "/login", Extract: map[string]extractRule{
+				"csrf": {Regex: `name="csrf" value="([^"]+)"`},
+			}},
+			{Name: "login", Url: "/login", Form: map[string]string{"user": "{{user}}", "csrf": "{{csrf}}"},
+				Keyword: "Welcome {{user}}", Extract: map[string]extractRule{
+					"name":  {Css: "h1.name"},
+					"order": {Css: "a.order", Attr: "href"},
+				}},
+			{Name: "api", Url: "{{order}}", Extract: map[string]extractRule{
+				"sku": {Json: "order.items.0.sku"},
+				"id":  {Json: "order.id"},
+			}},
+		},
+	}
+	target := targetConfig{moduleConfig: moduleConfig{Timeout: 5000}}
+
+	result := runScenario(scenario, &target, &influxConfig{}, nil)
+	if result.err != nil || len(result.steps) != 3 || result.status != NAGIOS_OK {
+		t.Fatalf("runScenario should pass 3 steps, got %d steps, status %d, error %v", len(result.steps), result.status, result.err)
+	}
+	if url := result.steps[2].target.Url; url != ts.URL+"/api?id=7" {
+		t.Errorf("api step url should be resolved against the previous step, got %s", url)
+	}
+	if sku, _ := jsonPath(result.steps[2].page.body, "order.items.0.sku"); sku != "A1" {
+		t.Errorf("jsonPath should return A1 but returned %s", sku)
+	}
+
+	//a wrong csrf token fails the login step and stops the scenario,
+	//the har archive still has the steps run
+	scenario.Steps[0].Extract["csrf"] = extractRule{Regex: `name="(csrf)"`}
+	target.Har = filepath.Join(t.TempDir(), "scenario.har")
+	result = runScenario(scenario, &target, &influxConfig{}, nil)
+	if result.err == nil || len(result.steps) != 2 || result.status != NAGIOS_ERROR {
+		t.Errorf("runScenario should fail at the login step, got %d steps, status %d, error %v", len(result.steps), result.status, result.err)
+	}
+	var archive har
+	if data, err := os.ReadFile(target.Har); err != nil || json.Unmarshal(data, &archive) != nil || len(archive.Log.Entries) != 2 {
+		t.Fatalf("the har of the failed scenario should have 2 entries, got %d, %v", len(archive.Log.Entries), err)
+	}
+	if login := archive.Log.Entries[1].Request; login.Method != "POST" || login.BodySize == 0 {
+		t.Errorf("the login form should be a POST with a body in the har, got %s of %d bytes", login.Method, login.BodySize)
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+
+	os.Setenv("ELMO_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("ELMO_TEST_PASSWORD")
+
+	s, err := expandVariables("{{user}}:{{ env.ELMO_TEST_PASSWORD }}", map[string]string{"user": "bob"})
+	if err != nil || s != "bob:secret" {
+		t.Errorf("expandVariables should return bob:secret but returned %s, %v", s, err)
+	}
+	if _, err := expandVariables("{{missing}}", nil); err == nil {
+		t.Errorf("expandVariables should fail on an undefined variable")
+	}
+}
+
+func TestAssertConfigCheck(t *testing.T) {
+
+	stat := downloadStatistic{
+		statusCode: 200,
+		responseHeader: http.Header{
+			"Content-Type":  {"text/html; charset=utf-8"},
+			"X-Powered-By":  {"PHP/5.6"},
+			"Cache-Control": {"max-age=60"},
+		},
+	}
+	body := []byte(`<html><body><div id="cart">Cart</div><p>Fatal error</p></body></html>`)
+
+	a := assertConfig{
+		Keywords:         []string{"Cart", "Checkout"},
+		NotKeywords:      []string{"Fatal error"},
+		Regex:            []string{`id="\w+"`},
+		Status:           []string{"2xx", "301"},
+		Headers:          map[string]string{"cache-control": "max-age=\\d+", "Strict-Transport-Security": ""},
+		ForbiddenHeaders: map[string]string{"X-Powered-By": "PHP"},
+		MaxBodySize:      10,
+		ContentType:      "text/html",
+		Css:              []string{"div#cart", "form.login"},
+		Xpath:            []string{"//div[@id='cart']", "//table"},
+		Warning:          []string{assertMaxBodySize},
+	}
+	if err := a.validate(); err != nil {
+		t.Fatalf("validate returned %v", err)
+	}
+
+	failures := a.check(&stat, body)
+	kinds := make(map[string]int)
+	for _, f := range failures {
+		kinds[f.kind]++
+	}
+	expected := map[string]int{
+		assertKeyword:         1,
+		assertNotKeyword:      1,
+		assertHeader:          1,
+		assertForbiddenHeader: 1,
+		assertMaxBodySize:     1,
+		assertCss:             1,
+		assertXpath:           1,
+	}
+	for kind, n := range expected {
+		if kinds[kind] != n {
+			t.Errorf("check should return %d %s failures but returned %d", n, kind, kinds[kind])
+		}
+	}
+	if len(failures) != 7 {
+		t.Errorf("check should return 7 failures but returned %v", failures)
+	}
+	if status := assertionsStatus(failures); status != NAGIOS_ERROR {
+		t.Errorf("assertionsStatus should return %d but returned %d", NAGIOS_ERROR, status)
+	}
+
+	warning := assertConfig{MaxBodySize: 10, Warning: []string{assertMaxBodySize}}
+	if status := assertionsStatus(warning.check(&stat, body)); status != NAGIOS_WARNING {
+		t.Errorf("assertionsStatus should return %d but returned %d", NAGIOS_WARNING, status)
+	}
+}
+
+func TestAssertFlagsWithCommas(t *testing.T) {
+
+	app := newApp()
+	var regex, notKeywords, resolve []string
+	app.Action = func(c *cli.Context) error {
+		regex = c.StringSlice("assert-regex")
+		notKeywords = c.StringSlice("assert-not-keyword")
+		resolve = c.StringSlice("resolve")
+		return nil
+	}
+	err := app.Run([]string{"elmo", "--url", "http://test.com/", "--assert-regex", "o{1,3}, w",
+		"--assert-not-keyword", "Fatal error, hello", "--resolve", "test.com:80:127.0.0.1,127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regex) != 1 || regex[0] != "o{1,3}, w" || len(notKeywords) != 1 || notKeywords[0] != "Fatal error, hello" {
+		t.Errorf("assertions should not be split on commas, got %q and %q", regex, notKeywords)
+	}
+	if len(resolve) != 1 {
+		t.Errorf("a --resolve with several addresses should be one value, got %q", resolve)
+	}
+
+	assertions := parseAssertFlags(nil, notKeywords, regex, nil, nil, nil, nil, 0, "", nil, nil, nil)
+	if failures := assertions.check(&downloadStatistic{statusCode: 200}, []byte("hello world")); len(failures) != 1 || failures[0].kind != assertRegex {
+		t.Errorf("only the regex should fail, got %+v", failures)
+	}
+}
+
+func TestParseStatusRange(t *testing.T) {
+
+	tests := []struct {
+		status    string
+		low, high int
+		fails     bool
+	}{
+		{"200", 200, 200, false},
+		{"3xx", 300, 399, false},
+		{"200-204", 200, 204, false},
+		{"9xx", 0, 0, true},
+		{"204-200", 0, 0, true},
+		{"ok", 0, 0, true},
+	}
+	for _, tt := range tests {
+		low, high, err := parseStatusRange(tt.status)
+		if (err != nil) != tt.fails || low != tt.low || high != tt.high {
+			t.Errorf("parseStatusRange(%s) returned %d, %d, %v", tt.status, low, high, err)
+		}
+	}
+}
+
+func TestCheckCertificates(t *testing.T) {
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html></html>")
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL}
+	page := fetchPage(config, ts.Client(), nil)
+	if page.err != nil {
+		t.Fatalf("fetchPage returned %v", page.err)
+	}
+
+	info := page.mainUrlStat.tls
+	if info == nil || info.version == "" || info.cipher == "" || len(info.certificates) == 0 {
+		t.Fatalf("main url tls info should be set, got %+v", info)
+	}
+	if sans := info.certificates[0].sans; len(sans) == 0 {
+		t.Errorf("certificate sans should be set")
+	}
+
+	// the httptest certificate expires in a few decades
+	days := int(time.Until(info.earliestExpiry()).Hours()/24) + 10
+
+	tests := []struct {
+		warning, critical int
+		status            int
+	}{
+		{0, 0, NAGIOS_OK},
+		{30, 14, NAGIOS_OK},
+		{days, 14, NAGIOS_WARNING},
+		{days, days, NAGIOS_ERROR},
+	}
+	for _, tt := range tests {
+		failures := checkCertificates(&page, tt.warning, tt.critical)
+		if status := assertionsStatus(failures); status != tt.status {
+			t.Errorf("checkCertificates(%d, %d) should return status %d but returned %v", tt.warning, tt.critical, tt.status, failures)
+		}
+	}
+}
+
+func TestNewHttpClientTls(t *testing.T) {
+
+	var serverName string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+		fmt.Fprint(w, "<html></html>")
+	}))
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tls        tlsClientConfig
+		ok         bool
+		serverName string
+	}{
+		{tlsClientConfig{}, false, ""},
+		{tlsClientConfig{insecure: true}, true, ""},
+		{tlsClientConfig{caFile: caFile}, true, ""},
+		{tlsClientConfig{caFile: caFile, serverName: "example.com", sniHost: "127.0.0.1"}, true, "example.com"},
+		{tlsClientConfig{caFile: caFile, serverName: "example.org", sniHost: "127.0.0.1"}, false, ""},
+		{tlsClientConfig{caFile: caFile, minVersion: "1.3"}, true, ""},
+	}
+	for _, tt := range tests {
+		serverName = ""
+		client, _, err := newHttpClient(&clientConfig{tls: tt.tls})
+		if err != nil {
+			t.Fatalf("newHttpClient(%+v) returned %v", tt.tls, err)
+		}
+		resp, err := client.Get(ts.URL)
+		if (err == nil) != tt.ok {
+			t.Errorf("get with %+v should succeed: %v, returned %v", tt.tls, tt.ok, err)
+			continue
+		}
+		if err == nil {
+			resp.Body.Close()
+			if serverName != tt.serverName {
+				t.Errorf("get with %+v should send server name %q but sent %q", tt.tls, tt.serverName, serverName)
+			}
+		}
+	}
+}
+
+func TestParseTlsSettings(t *testing.T) {
+
+	if v, err := parseTlsVersion("1.2"); err != nil || v != tls.VersionTLS12 {
+		t.Errorf("parseTlsVersion(1.2) returned %v, %v", v, err)
+	}
+	if _, err := parseTlsVersion("2.0"); err == nil {
+		t.Errorf("parseTlsVersion(2.0) should fail")
+	}
+
+	ids, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_AES_128_CBC_SHA")
+	if err != nil || len(ids) != 2 || ids[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("parseCipherSuites returned %v, %v", ids, err)
+	}
+	if _, err := parseCipherSuites("TLS_NOPE"); err == nil {
+		t.Errorf("parseCipherSuites(TLS_NOPE) should fail")
+	}
+}
+
+func TestNewHttpClientVersions(t *testing.T) {
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html></html>")
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+
+	//HTTP/3 on the same certificate
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", http3.ConfigureTLSConfig(&tls.Config{Certificates: h2.TLS.Certificates}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3 := &http3.Server{Handler: handler}
+	go h3.ServeListener(listener)
+	defer h3.Close()
+	h3Url := "https://" + listener.Addr().String()
+
+	tests := []struct {
+		url     string
+		version string
+		proto   string
+	}{
+		{h2.URL, httpVersionAuto, "HTTP/2.0"},
+		{h2.URL, httpVersion1, "HTTP/1.1"},
+		{h2.URL, httpVersion2, "HTTP/2.0"},
+		{h1.URL, httpVersionAuto, "HTTP/1.1"},
+		{h1.URL, httpVersion2, ""},
+		{h3Url, httpVersion3, "HTTP/3.0"},
+	}
+	for _, tt := range tests {
+		client, _, err := newHttpClient(&clientConfig{httpVersion: tt.version, tls: tlsClientConfig{insecure: true}})
+		if err != nil {
+			t.Fatalf("newHttpClient(%q) returned %v", tt.version, err)
+		}
+		_, stat, err := fetchMainUrl(tt.url, client, nil, "")
+		if tt.proto == "" {
+			if err == nil {
+				t.Errorf("fetch of %s with version %q should fail", tt.url, tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("fetch of %s with version %q returned %v", tt.url, tt.version, err)
+			continue
+		}
+		if stat.proto != tt.proto || stat.connection == "" {
+			t.Errorf("fetch of %s with version %q should use %s but used %s on %q", tt.url, tt.version, tt.proto, stat.proto, stat.connection)
+		}
+	}
+}
+
+func TestPageConnectionUsage(t *testing.T) {
+
+	t0 := time.Now()
+	stats := []downloadStatistic{
+		{proto: "HTTP/2.0", connection: "a", startTime: t0, responseTime: 100 * time.Millisecond},
+		{proto: "HTTP/2.0", connection: "a", startTime: t0.Add(10 * time.Millisecond), responseTime: 20 * time.Millisecond},
+		{proto: "HTTP/2.0", connection: "a", startTime: t0.Add(20 * time.Millisecond), responseTime: 20 * time.Millisecond},
+		{proto: "HTTP/1.1", connection: "b", startTime: t0, responseTime: 10 * time.Millisecond},
+		{proto: "HTTP/1.1", connection: "b", startTime: t0.Add(10 * time.Millisecond), responseTime: 10 * time.Millisecond},
+		{proto: "HTTP/1.1", cacheStatus: cacheHit},
+	}
+
+	usage := pageConnectionUsage(stats)
+	if usage.connections != 2 || usage.maxConcurrent != 3 {
+		t.Errorf("pageConnectionUsage should return 2 connections and 3 concurrent requests, returned %+v", usage)
+	}
+	if usage.formatProtocols() != "HTTP/1.1 x2, HTTP/2.0 x3" {
+		t.Errorf("formatProtocols returned %q", usage.formatProtocols())
+	}
+}
+
+func TestProxy(t *testing.T) {
+
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>origin</html>")
+	}))
+	defer origin.Close()
+
+	//forward proxy answering the plain http requests itself
+	//and tunneling every CONNECT to the origin
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			fmt.Fprint(w, "<html>proxied</html>")
+			return
+		}
+		upstream, err := net.Dial("tcp", origin.Listener.Addr().String())
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		buf.Flush()
+		go io.Copy(upstream, conn)
+		go io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	proxyHost := proxy.Listener.Addr().String()
+	proxyUrl := "http://user:secret@" + proxyHost
+	pacFile := filepath.Join(t.TempDir(), "proxy.pac")
+	pac := `function FindProxyForURL(url, host) {
+		if (dnsDomainIs(host, ".direct.test") || isPlainHostName(host) || shExpMatch(url, "*/api/*")) return "DIRECT";
+		if (host == "old.example.test") return "SOCKS4 old:1080; DIRECT";
+		return "SOCKS5 socks:1080; PROXY ` + proxyHost + `; DIRECT";
+	}`
+	if err := os.WriteFile(pacFile, []byte(pac), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		body string
+	}{
+		{"http://www.example.test/", "proxied"},
+		{"https://www.example.test/", "origin"},
+	}
+	for _, tt := range tests {
+		client, _, err := newHttpClient(&clientConfig{proxy: proxyConfig{url: proxyUrl}, tls: tlsClientConfig{insecure: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, stat, body, err := fetchMainRequest(&mainRequest{url: tt.url}, client, nil, "")
+		if err != nil {
+			t.Errorf("fetch of %s returned %v", tt.url, err)
+			continue
+		}
+		if !strings.Contains(string(body), tt.body) {
+			t.Errorf("fetch of %s should return %s but returned %s", tt.url, tt.body, body)
+		}
+		if stat.proxy != proxyHost || stat.proxyTime <= 0 || stat.connectTime != 0 {
+			t.Errorf("fetch of %s should record the proxy time, got proxy %q %v connect %v", tt.url, stat.proxy, stat.proxyTime, stat.connectTime)
+		}
+	}
+
+	//the proxied handshake would not require HTTP/2
+	client, _, err := newHttpClient(&clientConfig{httpVersion: httpVersion2, proxy: proxyConfig{url: proxyUrl}, tls: tlsClientConfig{insecure: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := fetchMainRequest(&mainRequest{url: "https://www.example.test/"}, client, nil, ""); err == nil || !strings.Contains(err.Error(), "proxy") {
+		t.Errorf("HTTP/2 only fetch through a proxy should fail, returned %v", err)
+	}
+
+	//the server name is only overridden for the main url host, whose certificate would be checked against the wrong name
+	sni := tlsClientConfig{insecure: true, serverName: "origin.example.test", sniHost: "www.example.test"}
+	client, _, err = newHttpClient(&clientConfig{proxy: proxyConfig{url: proxyUrl}, tls: sni})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := fetchMainRequest(&mainRequest{url: "https://www.example.test/"}, client, nil, ""); err == nil || !strings.Contains(err.Error(), "SNI") {
+		t.Errorf("fetch with an SNI override through a proxy should fail, returned %v", err)
+	}
+	if _, _, body, err := fetchMainRequest(&mainRequest{url: "https://cdn.example.test/"}, client, nil, ""); err != nil || !strings.Contains(string(body), "origin") {
+		t.Errorf("fetch of another host through a proxy should not be affected by the SNI override, returned %s, %v", body, err)
+	}
+
+	script, err := loadPac(pacFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the answers depend on the path of the http urls, they are not cached by host
+	for _, tt := range []struct{ url, proxy string }{
+		{"https://www.example.test/", "socks:1080"},
+		{"https://www.direct.test/", ""},
+		{"https://intranet/", ""},
+		{"http://www.example.test/api/users", ""},
+		{"http://www.example.test/", "socks:1080"},
+		{"https://www.example.test/api/users", "socks:1080"},
+	} {
+		u, _ := url.Parse(tt.url)
+		proxy, err := script.proxyForUrl(u)
+		got := ""
+		if proxy != nil {
+			got = proxy.Host
+		}
+		if err != nil || got != tt.proxy {
+			t.Errorf("PAC proxy of %s should be %q but returned %q, %v", tt.url, tt.proxy, got, err)
+		}
+	}
+	if _, err := script.proxyForUrl(&url.URL{Scheme: "https", Host: "old.example.test"}); err == nil || !strings.Contains(err.Error(), "SOCKS4") {
+		t.Errorf("PAC proxy of a SOCKS4 result should fail, returned %v", err)
+	}
+
+	//the daemon loads each PAC file once for all its targets
+	targets := []targetConfig{{Name: "home"}, {Name: "shop"}, {Name: "direct"}}
+	targets[0].ProxyPac, targets[1].ProxyPac = pacFile, pacFile
+	if err := loadTargetsPac(targets); err != nil || targets[0].pacScript == nil || targets[0].pacScript != targets[1].pacScript || targets[2].pacScript != nil {
+		t.Errorf("loadTargetsPac should share one script between the targets, returned %v", err)
+	}
+	targets[2].ProxyPac = filepath.Join(t.TempDir(), "missing.pac")
+	if err := loadTargetsPac(targets); err == nil {
+		t.Errorf("loadTargetsPac should fail on a missing PAC file")
+	}
+}
+
+func TestResolveOverrides(t *testing.T) {
+
+	values := []string{"*.example.com:443:10.0.0.1,[2001:db8::1]", "www.example.org:*:10.0.0.3", "[2001:db8::5]:8443:[::1]"}
+	resolver, err := newHostResolver(values, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, port string
+		addrs      []string
+	}{
+		{"www.example.com", "443", []string{"10.0.0.1", "2001:db8::1"}},
+		{"cdn.example.com", "443", []string{"2001:db8::1", "10.0.0.1"}},
+		{"www.example.com", "80", nil},
+		{"example.com", "443", nil},
+		{"WWW.example.org", "8080", []string{"10.0.0.3"}},
+		{"2001:db8::5", "8443", []string{"::1"}},
+	}
+	for _, tt := range tests {
+		var addrs []string
+		if o := resolver.findOverride(tt.host, tt.port); o != nil {
+			addrs = o.rotate()
+		}
+		if strings.Join(addrs, " ") != strings.Join(tt.addrs, " ") {
+			t.Errorf("override of %s:%s should be %v but was %v", tt.host, tt.port, tt.addrs, addrs)
+		}
+	}
+
+	for _, bad := range []string{"example.com:443", "example.com:443:nope", "example.com::10.0.0.1", "[2001:db8::5]:443", "[2001:db8::5:443:::1"} {
+		if _, err := parseResolveOverride(bad); err == nil {
+			t.Errorf("parseResolveOverride(%s) should fail", bad)
+		}
+	}
+}
+
+func TestDnsServer(t *testing.T) {
+
+	//answer www.example.test with a CNAME to its A record
+	answer := func(query []byte) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil {
+			return nil
+		}
+		msg.Response = true
+		q := msg.Questions[0]
+		if q.Type == dnsmessage.TypeA {
+			target := dnsmessage.MustNewName("origin.example.test.")
+			msg.Answers = []dnsmessage.Resource{
+				{Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+					Body: &dnsmessage.CNAMEResource{CNAME: target}},
+				{Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}},
+			}
+		}
+		packed, _ := msg.Pack()
+		return packed
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var length uint16
+			binary.Read(c, binary.BigEndian, &length)
+			query := make([]byte, length)
+			io.ReadFull(c, query)
+			packed := answer(query)
+			binary.Write(c, binary.BigEndian, uint16(len(packed)))
+			c.Write(packed)
+			c.Close()
+		}
+	}()
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answer(query))
+	}))
+	defer doh.Close()
+
+	for _, server := range []string{conn.LocalAddr().String(), "tcp://" + listener.Addr().String(), doh.URL + "/dns-query"} {
+		s, err := parseDnsServer(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.client != nil {
+			s.client = doh.Client()
+		}
+		info, err := s.lookup(context.Background(), "www.example.test", 0)
+		if err != nil {
+			t.Errorf("lookup on %s returned %v", server, err)
+			continue
+		}
+		if strings.Join(info.addrs, " ") != "127.0.0.1" || len(info.records) != 2 ||
+			info.records[0].rtype != "CNAME" || info.records[0].data != "origin.example.test" || info.records[1].ttl != 60 {
+			t.Errorf("lookup on %s returned %+v", server, info)
+		}
+	}
+
+	//a server that never answers does not hold a canceled lookup until its deadline
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	s, err := parseDnsServer(silent.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := s.lookup(ctx, "www.example.test", 4); err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("canceled lookup should fail at once, returned %v after %v", err, time.Since(start))
+	}
+}
+
+func TestBackends(t *testing.T) {
+
+	//listen on the whole loopback network, the page differs on 127.0.0.2
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Skip("cannot listen on all interfaces:", err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local := r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+		//the backend on 127.0.0.4 is down
+		if strings.HasPrefix(local, "127.0.0.4:") {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprintf(w, "<html><body>%v</body></html>", strings.HasPrefix(local, "127.0.0.2:"))
+	}))
+	ts.Listener.Close()
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	target := targetConfig{moduleConfig: moduleConfig{Timeout: 5000}, Url: "http://backends.example.test:" + port + "/",
+		NagiosWarning: 5000, NagiosCritical: 10000}
+
+	addrs, err := targetBackends(&target, []string{"127.0.0.1", "[127.0.0.3]"})
+	if err != nil || strings.Join(addrs, " ") != "127.0.0.1 127.0.0.3" {
+		t.Fatalf("targetBackends returned %v, %v", addrs, err)
+	}
+	target.Resolve = stringList{"backends.example.test:*:127.0.0.1,127.0.0.2,127.0.0.3"}
+	addrs, err = targetBackends(&target, nil)
+	if err != nil || len(addrs) != 3 {
+		t.Fatalf("targetBackends should resolve 3 addresses, returned %v, %v", addrs, err)
+	}
+	if _, err := targetBackends(&target, []string{"backends.example.test"}); err == nil {
+		t.Error("targetBackends should refuse a host name")
+	}
+	//the pin covers every port, like a redirect to https
+	if pinned, _ := backendTarget(&target, "127.0.0.2"); pinned.Resolve[0] != "backends.example.test:*:[127.0.0.2]" {
+		t.Errorf("backendTarget should pin the host on any port, pinned %s", pinned.Resolve[0])
+	}
+
+	backends, err := runBackends(&target, []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"}, true, &influxConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range backends {
+		if b.result.page.err != nil || b.result.status != NAGIOS_OK {
+			t.Fatalf("backend %s failed: %v", b.addr, b.result.page.err)
+		}
+		if b.differs != (i == 1) {
+			t.Errorf("backend %s content differs should be %v", b.addr, i == 1)
+		}
+	}
+	if status := backendsStatus(backends, 0); status != NAGIOS_WARNING {
+		t.Errorf("backendsStatus should be WARNING when a backend differs, got %d", status)
+	}
+
+	backends, _ = runBackends(&target, []string{"127.0.0.1", "127.0.0.3"}, false, &influxConfig{}, nil)
+	if status := backendsStatus(backends, 0); status != NAGIOS_OK {
+		t.Errorf("backendsStatus should be OK, got %d", status)
+	}
+
+	//one backend down and one healthy
+	backends, _ = runBackends(&target, []string{"127.0.0.1", "127.0.0.4"}, false, &influxConfig{}, nil)
+	if backends[0].result.status != NAGIOS_OK || backends[1].result.status != NAGIOS_ERROR {
+		t.Fatalf("backend 127.0.0.4 should be down, got %d and %d", backends[0].result.status, backends[1].result.status)
+	}
+	if status := backendsStatus(backends, 0); status != NAGIOS_WARNING {
+		t.Errorf("backendsStatus should be WARNING with one backend down, got %d", status)
+	}
+	if status := backendsStatus(backends, 1); status != NAGIOS_ERROR {
+		t.Errorf("backendsStatus should be CRITICAL with one backend down out of 1 allowed, got %d", status)
+	}
+}
+
+func TestFrames(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><img src="/1.png"><iframe src="/ad.html"></iframe><object data="/1.svg"></object></html>`)
+		case "/ad.html":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><img src="/ad.png"><img src="/1.png"><iframe src="/tracker.html"></iframe></html>`)
+		case "/tracker.html":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><script src="/t.js"></script><iframe src="/ad.html"></iframe></html>`)
+		default:
+			fmt.Fprint(w, "asset")
+		}
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8}
+	page := fetchPage(config, ts.Client(), nil)
+	if len(page.assets) != 1 {
+		t.Errorf("frames should be ignored without a frame depth, fetched %v", page.assets)
+	}
+
+	config.frameDepth = 1
+	page = fetchPage(config, ts.Client(), nil)
+	frames := pageFrames(&page)
+	if len(page.assets) != 4 || len(frames) != 2 || frames[0].stat.url != ts.URL+"/ad.html" || frames[0].assets != 1 || frames[1].assets != 0 {
+		t.Fatalf("depth 1 should fetch the ad frame and its png, fetched %v", page.assets)
+	}
+
+	//the nested frame loops back to the ad frame, which is fetched once
+	config.frameDepth = 3
+	page = fetchPage(config, ts.Client(), nil)
+	parents := make(map[string]string)
+	for _, stat := range page.assetsStats {
+		parents[strings.TrimPrefix(stat.url, ts.URL)] = strings.TrimPrefix(stat.frame, ts.URL)
+	}
+	expected := map[string]string{"/": "", "/1.png": "", "/1.svg": "", "/ad.html": "", "/ad.png": "/ad.html",
+		"/tracker.html": "/ad.html", "/t.js": "/tracker.html"}
+	if fmt.Sprint(parents) != fmt.Sprint(expected) {
+		t.Errorf("frames of the assets should be %v but were %v", expected, parents)
+	}
+	frames = pageFrames(&page)
+	if len(frames) != 3 || frames[1].stat.url != ts.URL+"/tracker.html" || frames[1].stat.frameDepth != 2 {
+		t.Errorf("the tracker frame should be nested in the ad frame, frames were %+v", frames)
+	}
+	if har := buildHar(page.assetsStats, page.failedStats, page.gstat); len(har.Log.Entries) != 7 {
+		t.Errorf("the har should have 7 entries but has %d", len(har.Log.Entries))
+	}
+}
+
+func TestLinkRelations(t *testing.T) {
+
+	const htmlBody = `<head>
+		<link rel="Stylesheet preload" href="/1.css">
+		<link rel="preload" as="font" href="/f.woff2" crossorigin>
+		<link rel="modulepreload" href="/app.mjs">
+		<link rel="shortcut icon" href="/favicon.ico">
+		<link rel="apple-touch-icon" href="/touch.png">
+		<link rel="manifest" href="/site.webmanifest">
+		<link rel="prefetch" href="/next.html">
+		<link rel="alternate" href="/feed.xml">
+		<link rel="preconnect" href="https://cdn.test.com">
+		</head><body><img src="/1.png"></body>`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, htmlBody)
+		case "/site.webmanifest":
+			w.Header().Set("Content-Type", "application/manifest+json")
+			fmt.Fprint(w, `{"name": "test", "icons": [{"src": "icons/192.png", "sizes": "192x192"}, {"src": "/favicon.ico"}]}`)
+		default:
+			fmt.Fprint(w, "asset")
+		}
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8}
+	page := fetchPage(config, ts.Client(), nil)
+
+	reasons := make(map[string]string)
+	for _, stat := range page.assetsStats[1:] {
+		reasons[strings.TrimPrefix(stat.url, ts.URL)] = stat.reason
+	}
+	expected := map[string]string{"/1.css": "stylesheet", "/f.woff2": "preload font", "/app.mjs": "modulepreload",
+		"/favicon.ico": "icon", "/touch.png": "apple-touch-icon", "/site.webmanifest": "manifest",
+		"/icons/192.png": "manifest icon", "/1.png": "img"}
+	if fmt.Sprint(reasons) != fmt.Sprint(expected) {
+		t.Errorf("assets should be found by %v but were by %v", expected, reasons)
+	}
+	if len(page.prefetch) != 1 || page.prefetch[0] != ts.URL+"/next.html" {
+		t.Errorf("the prefetch hint should be listed, not fetched, got %v", page.prefetch)
+	}
+
+	config.includePrefetch = true
+	page = fetchPage(config, ts.Client(), nil)
+	if len(page.prefetch) != 0 || pageReasons(&page)[reasonPrefetch] != 1 {
+		t.Errorf("the prefetch hint should be fetched with --include-prefetch, got %v", pageReasons(&page))
+	}
+}
+
+func TestStreamedAssets(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><video src="/big.mp4"></video><script src="/slow.js"></script><link rel="stylesheet" href="/big.css"></html>`)
+		case "/big.mp4":
+			w.Write(make([]byte, 1<<20))
+		case "/big.css":
+			fmt.Fprintf(w, ".a { background: url(a.png) }%s", strings.Repeat(" ", 2048))
+		case "/slow.js":
+			//the body comes 100ms after the headers, in two chunks
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, "var a;")
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, "var b;")
+		}
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8, maxAssetSize: 1024, hashAssets: true}
+	page := fetchPage(config, ts.Client(), nil)
+
+	stats := make(map[string]downloadStatistic)
+	for _, stat := range page.assetsStats {
+		stats[strings.TrimPrefix(stat.url, ts.URL)] = stat
+	}
+	if s := stats["/big.mp4"]; !s.oversized || s.responseSize != 1025 || s.sha256 != "" {
+		t.Errorf("big.mp4 should be aborted after 1025 bytes, got %d bytes, oversized %v", s.responseSize, s.oversized)
+	}
+	if _, ok := stats["/a.png"]; ok || len(page.assets) != 3 {
+		t.Errorf("the links of an oversized stylesheet should be dropped, fetched %v", page.assets)
+	}
+	slow := stats["/slow.js"]
+	//the download starts with the headers, the margin covers the delivery of the headers
+	if slow.oversized || slow.responseSize != 12 || slow.responseTime < 100*time.Millisecond || slow.downloadTime < 50*time.Millisecond {
+		t.Errorf("slow.js should take 12 bytes until the last one, got %d bytes in %v, downloaded in %v", slow.responseSize, slow.responseTime, slow.downloadTime)
+	}
+	if sum := sha256.Sum256([]byte("var a;var b;")); slow.sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("slow.js sha256 should be recorded, got %s", slow.sha256)
+	}
+	if len(page.failures) != 2 || page.failures[0].kind != assertMaxAssetSize || assertionsStatus(page.failures) != NAGIOS_WARNING {
+		t.Errorf("the oversized assets should be 2 warnings, got %+v", page.failures)
+	}
+}
+
+func TestCompression(t *testing.T) {
+
+	script := strings.Repeat("var a = 1;\n", 500)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != acceptEncoding {
+			t.Errorf("assets should accept %s, got %s", acceptEncoding, r.Header.Get("Accept-Encoding"))
+		}
+		var body io.WriteCloser
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<html><script src="/gzip.js"></script><script src="/br.js"></script><script src="/zstd.js"></script><script src="/plain.js"></script><img src="/a.png"><img src="/empty.png"></html>`)
+			return
+		case "/empty.png":
+			//an empty body has no zlib header
+			w.Header().Set("Content-Encoding", "deflate")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case "/gzip.js":
+			w.Header().Set("Content-Encoding", "gzip")
+			body = gzip.NewWriter(w)
+		case "/br.js":
+			w.Header().Set("Content-Encoding", "br")
+			body = brotli.NewWriter(w)
+		case "/zstd.js":
+			w.Header().Set("Content-Encoding", "zstd")
+			body, _ = zstd.NewWriter(w)
+		case "/plain.js":
+			w.Header().Set("Content-Type", "application/javascript")
+			fmt.Fprint(w, script)
+			return
+		case "/a.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(make([]byte, 4096))
+			return
+		}
+		w.Header().Set("Content-Type", "application/javascript")
+		fmt.Fprint(body, script)
+		body.Close()
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8, auditCompression: true}
+	page := fetchPage(config, ts.Client(), nil)
+
+	stats := make(map[string]downloadStatistic)
+	for _, stat := range page.assetsStats {
+		stats[strings.TrimPrefix(stat.url, ts.URL)] = stat
+	}
+	if len(page.failedStats) != 0 {
+		t.Errorf("an empty deflate body should not fail, got %v", page.failedStats[0].err)
+	}
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		s := stats["/"+encoding+".js"]
+		if s.contentEncoding != encoding || s.responseSize != len(script) || s.encodedSize == 0 || s.encodedSize >= s.responseSize {
+			t.Errorf("%s.js should be decoded to %d bytes, got %d bytes from %d %s bytes", encoding, len(script), s.responseSize, s.encodedSize, s.contentEncoding)
+		}
+	}
+	if s := stats["/plain.js"]; s.contentEncoding != "" || s.encodedSize != len(script) || s.gzipSize == 0 {
+		t.Errorf("plain.js should be transferred as is with a gzip estimate, got %d bytes, gzip %d", s.encodedSize, s.gzipSize)
+	}
+
+	issues, savings := auditCompression(&page)
+	if len(issues) != 1 || !strings.HasSuffix(issues[0].url, "/plain.js") || savings != len(script)-issues[0].gzipSize {
+		t.Errorf("only plain.js should be reported without compression, got %+v", issues)
+	}
+	if page.gstat.totalEncodedSize >= page.gstat.totalResponseSize {
+		t.Errorf("the transferred size %d should be below the decoded size %d", page.gstat.totalEncodedSize, page.gstat.totalResponseSize)
+	}
+}
+
+func TestCacheAudit(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Cache-Control", "max-age=86400")
+			fmt.Fprint(w, `<html><script src="/app.3f2a9c1b.js"></script><script src="/api.json"></script><img src="/logo.png"><link rel="stylesheet" href="/style.css"></html>`)
+		case "/app.3f2a9c1b.js":
+			w.Header().Set("Cache-Control", "public, max-age=600")
+			fmt.Fprint(w, "var a;")
+		case "/api.json":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write(make([]byte, 4096))
+		case "/logo.png":
+			w.Header().Set("Cache-Control", "max-age=31536000")
+			w.Header().Set("Age", "100")
+			w.Write(make([]byte, 100))
+		case "/style.css":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, "a {}")
+		}
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8, auditCache: true, maxUncacheable: 50}
+	page := fetchPage(config, ts.Client(), nil)
+
+	issues, uncacheable, total := auditCache(&page)
+	found := make(map[string]cacheIssue)
+	for _, issue := range issues {
+		found[strings.TrimPrefix(issue.url, ts.URL)] = issue
+	}
+	if len(issues) != 3 || found["/"].ttl != 24*time.Hour || found["/app.3f2a9c1b.js"].ttl != 10*time.Minute || found["/api.json"].message != "uncacheable" {
+		t.Errorf("the long html, short fingerprinted and no-store responses should be reported, got %+v", issues)
+	}
+	if uncacheable != 4096 || total <= uncacheable {
+		t.Errorf("only api.json should be uncacheable, got %d of %d bytes", uncacheable, total)
+	}
+	for _, stat := range page.assetsStats {
+		if strings.HasSuffix(stat.url, "/logo.png") {
+			if p := newCachePolicy(&stat); p.ttl != 31536000*time.Second-100*time.Second || p.uncacheable() || p.fingerprinted {
+				t.Errorf("logo.png ttl should be reduced by its age, got %v", p.ttl)
+			}
+		}
+	}
+	if len(page.failures) != 1 || page.failures[0].kind != assertUncacheable || assertionsStatus(page.failures) != NAGIOS_WARNING {
+		t.Errorf("the uncacheable share should be a warning, got %+v", page.failures)
+	}
+
+	for u, want := range map[string]bool{
+		"https://a.com/main-5d7e3a1f0b.css": true,
+		"https://a.com/app.js?v=12":         true,
+		"https://a.com/app.js":              false,
+		"https://a.com/deadline.js":         false,
+	} {
+		if isFingerprinted(u) != want {
+			t.Errorf("isFingerprinted(%s) should be %v", u, want)
+		}
+	}
+}
+
+func TestSecurityAudit(t *testing.T) {
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "a")
+	}))
+	defer plain.Close()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=3600")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "strict-origin, unsafe-url")
+		fmt.Fprintf(w, `<html><img src="%[1]s/a.png"><script src="%[1]s/a.js"></script><img src="/b.png"></html>`, plain.URL)
+	}))
+	defer ts.Close()
+
+	config := &pageConfig{url: ts.URL + "/", headers: make(map[string]string), parallel: 8, auditSecurity: true}
+	page := fetchPage(config, ts.Client(), nil)
+
+	headers := make(map[string]securityHeader)
+	for _, h := range auditSecurityHeaders(&page.mainUrlStat) {
+		headers[h.name] = h
+	}
+	for name, status := range map[string]string{
+		"Strict-Transport-Security": headerWeak,
+		"Content-Security-Policy":   headerOk,
+		"X-Frame-Options":           headerOk,
+		"X-Content-Type-Options":    headerOk,
+		"Referrer-Policy":           headerWeak,
+		"Permissions-Policy":        headerMissing,
+	} {
+		if headers[name].status != status {
+			t.Errorf("%s should be %s, got %+v", name, status, headers[name])
+		}
+	}
+
+	mixed := auditMixedContent(&page)
+	if len(mixed) != 2 {
+		t.Fatalf("the 2 http resources should be mixed content, got %+v", mixed)
+	}
+	for _, m := range mixed {
+		if m.active != strings.HasSuffix(m.url, ".js") || m.document != ts.URL+"/" {
+			t.Errorf("only the script should be active mixed content, got %+v", m)
+		}
+	}
+	if len(page.failures) != 2 || page.failures[1].kind != assertMixedContent || assertionsStatus(page.failures) != NAGIOS_ERROR {
+		t.Errorf("the weak headers should be a warning and the active mixed content critical, got %+v", page.failures)
+	}
+
+	//the http resources outside the allowed domains are not fetched but still flagged
+	config.assetsAllowedDomains = strings.TrimPrefix(ts.URL, "https://")
+	page = fetchPage(config, ts.Client(), nil)
+	if mixed := auditMixedContent(&page); len(page.assetsStats) != 2 || len(mixed) != 2 {
+		t.Errorf("the 2 http resources not fetched should be mixed content, fetched %d, got %+v", len(page.assetsStats), mixed)
+	}
+
+	//a page redirected to http has no HSTS
+	stat := downloadStatistic{url: "https://a.com/", finalUrl: "http://a.com/", responseHeader: http.Header{}}
+	if h := auditSecurityHeaders(&stat)[0]; h.status != headerMissing || h.message != "page served over http" {
+		t.Errorf("HSTS should be missing on an http page, got %+v", h)
+	}
+}
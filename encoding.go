@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encodings asked like a browser, the bodies are decoded by elmo
+// so the transferred size is known
+const acceptEncoding = "gzip, deflate, br, zstd"
+
+// Responses smaller than this are not worth compressing
+const minCompressSize = 1024
+
+// Ask for compressed responses, unless the request headers already choose
+func setAcceptEncoding(req *http.Request) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+}
+
+// Decode a response body by its Content-Encoding, the encoded bytes are written to transferred.
+// Unknown encodings are read as is. The decoder must be closed.
+func decodeBody(resp *http.Response, transferred io.Writer) (io.ReadCloser, error) {
+	raw := io.TeeReader(resp.Body, transferred)
+
+	switch contentEncoding(resp) {
+	case "gzip", "x-gzip":
+		//an empty body has no gzip header
+		buffered := bufio.NewReader(raw)
+		if _, err := buffered.Peek(1); err == io.EOF {
+			return ioutil.NopCloser(buffered), nil
+		}
+		return gzip.NewReader(buffered)
+	case "deflate":
+		//deflate is zlib wrapped, some servers send it raw.
+		//An empty body has no zlib header either.
+		buffered := bufio.NewReader(raw)
+		if _, err := buffered.Peek(1); err == io.EOF {
+			return ioutil.NopCloser(buffered), nil
+		}
+		if header, err := buffered.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(raw)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(raw, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(raw), nil
+}
+
+// Decoded body of a response. The transferred bytes are counted,
+// and the gzip size of uncompressed text is estimated when auditing.
+type responseBody struct {
+	io.Reader
+	decoder     io.ReadCloser
+	encoding    string
+	transferred *bodyCounter
+	estimate    *gzipEstimate
+}
+
+func newResponseBody(resp *http.Response, audit bool) (*responseBody, error) {
+	b := &responseBody{encoding: contentEncoding(resp), transferred: newBodyCounter(false)}
+	decoder, err := decodeBody(resp, b.transferred)
+	if err != nil {
+		return nil, err
+	}
+	b.decoder, b.Reader = decoder, decoder
+	if audit && b.encoding == "" && isCompressible(resp.Header) {
+		b.estimate = newGzipEstimate()
+		b.Reader = io.TeeReader(decoder, b.estimate)
+	}
+	return b, nil
+}
+
+func (b *responseBody) Close() error {
+	return b.decoder.Close()
+}
+
+// Set the transfer statistics of the body read so far,
+// a body served by the cache is not transferred
+func (b *responseBody) fill(stat *downloadStatistic) {
+	stat.encodedSize = b.transferred.n
+	if stat.cacheStatus != "" {
+		stat.encodedSize = 0
+	}
+	stat.contentEncoding = b.encoding
+	if b.estimate != nil {
+		stat.gzipSize = b.estimate.size()
+	}
+}
+
+// Content encoding of a response, empty for identity
+func contentEncoding(resp *http.Response) string {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// Check if a response is text that should be compressed: html, css, javascript, json, svg or xml
+func isCompressible(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/x-javascript", "application/ecmascript",
+		"application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// Estimate the gzip size of a body while it is streamed
+type gzipEstimate struct {
+	counter *bodyCounter
+	writer  *gzip.Writer
+}
+
+func newGzipEstimate() *gzipEstimate {
+	e := &gzipEstimate{counter: newBodyCounter(false)}
+	e.writer = gzip.NewWriter(e.counter)
+	return e
+}
+
+func (e *gzipEstimate) Write(p []byte) (int, error) {
+	return e.writer.Write(p)
+}
+
+// Gzip size of the body written so far
+func (e *gzipEstimate) size() int {
+	e.writer.Close()
+	return e.counter.n
+}
+
+// A text response served without compression
+type compressionIssue struct {
+	url         string
+	contentType string
+	size        int
+	gzipSize    int
+}
+
+// Text responses of a page served without compression, largest savings first
+func auditCompression(page *pageResult) (issues []compressionIssue, savings int) {
+	for _, stat := range page.assetsStats {
+		if stat.gzipSize == 0 || stat.responseSize < minCompressSize || stat.gzipSize >= stat.responseSize {
+			continue
+		}
+		issues = append(issues, compressionIssue{
+			url:         stat.url,
+			contentType: stat.responseHeader.Get("Content-Type"),
+			size:        stat.responseSize,
+			gzipSize:    stat.gzipSize,
+		})
+		savings += stat.responseSize - stat.gzipSize
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].size-issues[i].gzipSize > issues[j].size-issues[j].gzipSize
+	})
+	return
+}
+
+// Print the text responses served without compression
+func printCompressionAudit(page *pageResult) {
+	issues, savings := auditCompression(page)
+	if len(issues) == 0 {
+		fmt.Println("Compression audit: all the text responses are compressed.")
+		return
+	}
+	fmt.Printf("Compression audit: %d text responses without compression, %vkb could be saved with gzip.\n",
+		len(issues), savings/1024)
+	for _, issue := range issues {
+		fmt.Printf("\t%s %s %vkb, %vkb with gzip\n", issue.url, issue.contentType, issue.size/1024, issue.gzipSize/1024)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A frame document of a page with the resources found in it
+type frameSummary struct {
+	stat         *downloadStatistic
+	assets       int // resources of the frame, without its nested frames
+	failed       int
+	responseSize int // frame document and its resources
+}
+
+// Downloaded frame documents of a page, each one followed by its nested frames
+func pageFrames(page *pageResult) []frameSummary {
+	summaries := make(map[string]*frameSummary)
+	for i := range page.assetsStats {
+		stat := &page.assetsStats[i]
+		if stat.frameDepth > 0 {
+			summaries[stat.url] = &frameSummary{stat: stat, responseSize: stat.responseSize}
+		}
+	}
+	//nested frames in the order they were found, duplicates are listed once
+	children := make(map[string][]string)
+	listed := make(map[string]bool)
+	for _, u := range page.assets {
+		if f, ok := summaries[u]; ok && !listed[u] {
+			children[f.stat.frame] = append(children[f.stat.frame], u)
+			listed[u] = true
+		}
+	}
+	for i := range page.assetsStats {
+		stat := &page.assetsStats[i]
+		if f, ok := summaries[stat.frame]; ok && stat.frameDepth == 0 {
+			f.assets++
+			f.responseSize += stat.responseSize
+		}
+	}
+	for i := range page.failedStats {
+		if f, ok := summaries[page.failedStats[i].frame]; ok {
+			f.failed++
+		}
+	}
+
+	//depth first from the page frames
+	var frames []frameSummary
+	var walk func(parent string)
+	walk = func(parent string) {
+		for _, u := range children[parent] {
+			frames = append(frames, *summaries[u])
+			walk(u)
+		}
+	}
+	walk("")
+	return frames
+}
+
+// Print the frame documents count, and their hierarchy in verbose mode
+func printFrames(page *pageResult) {
+	frames := pageFrames(page)
+	if len(frames) == 0 {
+		return
+	}
+
+	var assets, size int
+	for _, f := range frames {
+		assets += f.assets
+		size += f.responseSize
+	}
+	fmt.Printf("Frames: %d documents, %d assets, %vkb.\n", len(frames), assets, size/1024)
+	if !verbose {
+		return
+	}
+	for _, f := range frames {
+		failed := ""
+		if f.failed > 0 {
+			failed = fmt.Sprintf(", %d failed", f.failed)
+		}
+		fmt.Printf("%s%s %d %v, %d assets%s, %vkb\n", strings.Repeat("\t", f.stat.frameDepth), f.stat.url,
+			f.stat.statusCode, f.stat.responseTime.Round(time.Millisecond), f.assets, failed, f.responseSize/1024)
+	}
+}
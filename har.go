@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// HAR 1.2 archive, see http://www.softwareishard.com/blog/har-12-spec/
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Pages   []harPage  `json:"pages"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harPage struct {
+	StartedDateTime string         `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     harPageTimings `json:"pageTimings"`
+}
+
+type harPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+type harEntry struct {
+	Pageref         string      `json:"pageref"`
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Frame           string      `json:"_frame,omitempty"`      // frame document of the resource
+	FrameDepth      int         `json:"_frameDepth,omitempty"` // nesting level of a frame document
+	Reason          string      `json:"_reason,omitempty"`     // why the resource was fetched
+	Error           string      `json:"_error,omitempty"`      // fetch error of a failed request
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	Ssl     float64 `json:"ssl"`
+}
+
+const harPageId = "page_1"
+
+// Build the HAR archive of a page fetch, the first statistic is the main url.
+// The failed requests are added after the downloaded ones.
+func buildHar(assetsStats []downloadStatistic, failedStats []downloadStatistic, gstat globalStatistic) har {
+	h := har{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "elmo", Version: VERSION},
+		Pages:   []harPage{},
+		Entries: []harEntry{},
+	}}
+
+	if len(assetsStats) == 0 {
+		return h
+	}
+
+	mainUrlStat := assetsStats[0]
+	h.Log.Pages = append(h.Log.Pages, harPage{
+		StartedDateTime: mainUrlStat.startTime.Format(time.RFC3339Nano),
+		ID:              harPageId,
+		Title:           mainUrlStat.url,
+		PageTimings: harPageTimings{
+			OnContentLoad: -1,
+			OnLoad:        msec(gstat.totalResponseTime),
+		},
+	})
+
+	for i := range assetsStats {
+		h.Log.Entries = append(h.Log.Entries, harEntryFromStat(&assetsStats[i]))
+	}
+	for i := range failedStats {
+		h.Log.Entries = append(h.Log.Entries, harEntryFromStat(&failedStats[i]))
+	}
+
+	return h
+}
+
+// Convert a downloadStatistic to a HAR entry
+func harEntryFromStat(stat *downloadStatistic) harEntry {
+	timings := harTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		Ssl:     -1,
+		Send:    msec(stat.sendTime),
+		Wait:    msec(stat.ttfb),
+		Receive: msec(stat.downloadTime),
+	}
+	if !stat.connReused {
+		timings.DNS = msec(stat.dnsTime)
+		// HAR connect time includes the ssl time
+		timings.Connect = msec(stat.proxyTime + stat.connectTime + stat.tlsTime)
+		if stat.tlsTime > 0 {
+			timings.Ssl = msec(stat.tlsTime)
+		}
+	}
+
+	total := timings.Send + timings.Wait + timings.Receive
+	if timings.DNS > 0 {
+		total += timings.DNS
+	}
+	if timings.Connect > 0 {
+		total += timings.Connect
+	}
+
+	method := stat.method
+	if method == "" {
+		method = "GET"
+	}
+
+	entry := harEntry{
+		Pageref:         harPageId,
+		StartedDateTime: stat.startTime.Format(time.RFC3339Nano),
+		Time:            total,
+		Request: harRequest{
+			Method:      method,
+			URL:         stat.url,
+			HTTPVersion: stat.proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(stat.requestHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    stat.bodySize,
+		},
+		Response: harResponse{
+			Status:      stat.statusCode,
+			StatusText:  http.StatusText(stat.statusCode),
+			HTTPVersion: stat.proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(stat.responseHeader),
+			Content: harContent{
+				Size:        stat.responseSize,
+				Compression: stat.responseSize - stat.encodedSize,
+				MimeType:    stat.responseHeader.Get("Content-Type"),
+			},
+			RedirectURL: stat.responseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    stat.encodedSize,
+		},
+		Timings:    timings,
+		Frame:      stat.frame,
+		FrameDepth: stat.frameDepth,
+		Reason:     stat.reason,
+	}
+
+	if u, err := url.Parse(stat.url); err == nil {
+		for k, values := range u.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{k, v})
+			}
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(stat.remoteAddr); err == nil {
+		entry.ServerIPAddress = host
+	}
+
+	//a failed request has no response, like in the browsers archives
+	if stat.err != nil {
+		entry.Response.Status = 0
+		entry.Response.StatusText = ""
+		entry.Error = stat.err.Error()
+	}
+
+	return entry
+}
+
+// Convert http headers to HAR name/value pairs
+func harHeaders(header http.Header) []harNameValue {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := []harNameValue{}
+	for _, k := range keys {
+		for _, v := range header[k] {
+			headers = append(headers, harNameValue{k, v})
+		}
+	}
+	return headers
+}
+
+// Write the HAR archive of a page fetch to a file
+func writeHar(harFile string, assetsStats []downloadStatistic, failedStats []downloadStatistic, gstat globalStatistic) error {
+	f, err := os.Create(harFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(buildHar(assetsStats, failedStats, gstat))
+}
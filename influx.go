@@ -1,52 +1,278 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+)
+
+// Influxdb sink settings
+type influxConfig struct {
+	url         string
+	version     int
+	database    string // v1
+	username    string // v1
+	password    string // v1
+	org         string // v2
+	bucket      string // v2
+	token       string // v2
+	measurement string
+	tags        map[string]string
+}
 
-	_ "github.com/influxdata/influxdb1-client" // this is important because of the bug in go mod
-	client "github.com/influxdata/influxdb1-client/v2"
+// Parse the extra tags given as key=value
+func parseInfluxTags(values []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, v := range values {
+		k, tag, ok := strings.Cut(v, "=")
+		if !ok || k == "" {
+			return nil, errors.New("bad argument -influx-tag " + v)
+		}
+		tags[k] = tag
+	}
+	return tags, nil
+}
+
+var (
+	lineMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	lineTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	lineStringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
 )
 
-//Send statistic data to influxdb
-func sendstatsToInflux(influxUrl string, influxDatabase string, mainUrl string, assetsStats *[]downloadStatistic) {
-	// Make client
-	c, err := client.NewHTTPClient(client.HTTPConfig{Addr: influxUrl})
-	if err != nil {
-		fmt.Println(red("Influxdb - error creating InfluxDB Client:\n"), err.Error())
+// A line protocol point
+type linePoint struct {
+	tags   map[string]string
+	fields map[string]interface{}
+	time   time.Time
+}
+
+// Format a point in the influxdb line protocol
+func (p *linePoint) format(measurement string) string {
+	var b strings.Builder
+	b.WriteString(lineMeasurementEscaper.Replace(measurement))
+
+	keys := make([]string, 0, len(p.tags))
+	for k := range p.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// empty tag values are not allowed
+		if p.tags[k] == "" {
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", lineTagEscaper.Replace(k), lineTagEscaper.Replace(p.tags[k]))
 	}
 
-	// Create a new point batch
-	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  influxDatabase,
-		Precision: "s",
-	})
+	keys = keys[:0]
+	for k := range p.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		b.WriteString(sep + lineTagEscaper.Replace(k) + "=")
+		switch v := p.fields[k].(type) {
+		case int:
+			b.WriteString(strconv.Itoa(v) + "i")
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10) + "i")
+		case time.Duration:
+			b.WriteString(strconv.FormatInt(int64(v), 10) + "i")
+		case bool:
+			b.WriteString(strconv.FormatBool(v))
+		case string:
+			b.WriteString(`"` + lineStringEscaper.Replace(v) + `"`)
+		default:
+			fmt.Fprintf(&b, "%v", v)
+		}
+	}
+
+	fmt.Fprintf(&b, " %d\n", p.time.UnixNano())
+	return b.String()
+}
+
+// Build the points of a page fetch: one per downloaded url and one for the whole page
+func pagePoints(page *pageResult, extraTags map[string]string) []linePoint {
+	var points []linePoint
+
+	mainUrl := page.mainUrlStat.url
+
+	tags := func(t map[string]string) map[string]string {
+		for k, v := range extraTags {
+			if _, ok := t[k]; !ok {
+				t[k] = v
+			}
+		}
+		return t
+	}
 
-	//we want all the points of the batch to the same time
-	influxTime := time.Now()
+	for i, stat := range page.assetsStats {
+		statType := "asset"
+		if i == 0 {
+			statType = "main"
+		}
+
+		host := ""
+		if u, err := url.Parse(stat.url); err == nil {
+			host = u.Host
+		}
+		contentType, _, _ := mime.ParseMediaType(stat.responseHeader.Get("Content-Type"))
 
-	//prepare data for influx
-	for _, stat := range *assetsStats {
-		// Create a point and add to batch
-		tags := map[string]string{"url": stat.url}
-		//var tags map[string]string
 		fields := map[string]interface{}{
-			"responseTime": int64(stat.responseTime),
+			"url":          stat.url,
+			"statusCode":   stat.statusCode,
+			"responseTime": stat.responseTime,
 			"responseSize": stat.responseSize,
+			"encodedSize":  stat.encodedSize,
+			"dnsTime":      stat.dnsTime,
+			"connectTime":  stat.connectTime,
+			"proxyTime":    stat.proxyTime,
+			"tlsTime":      stat.tlsTime,
+			"sendTime":     stat.sendTime,
+			"ttfb":         stat.ttfb,
+			"downloadTime": stat.downloadTime,
+			"connReused":   stat.connReused,
 		}
-		pt, err := client.NewPoint(mainUrl, tags, fields, influxTime)
-		if err != nil {
-			fmt.Println(red("Influxdb - error:\n"), err.Error())
+		if stat.err != nil {
+			fields["error"] = stat.err.Error()
 		}
-		bp.AddPoint(pt)
-		//if (*verbose) {
-		//	fmt.Printf("influx: %v\n", pt)
-		//}
+
+		points = append(points, linePoint{
+			tags: tags(map[string]string{
+				"main_url":     mainUrl,
+				"type":         statType,
+				"host":         host,
+				"content_type": contentType,
+				"status_class": statusClass(stat.statusCode),
+			}),
+			fields: fields,
+			time:   stat.startTime,
+		})
 	}
 
-	//Send data to influx
-	err = c.Write(bp)
+	fields := map[string]interface{}{
+		"statusCode":        page.mainUrlStat.statusCode,
+		"totalResponseTime": page.gstat.totalResponseTime,
+		"totalResponseSize": page.gstat.totalResponseSize,
+		"totalEncodedSize":  page.gstat.totalEncodedSize,
+		"assets":            len(page.assets),
+		"failed":            len(page.failedStats),
+	}
+	//a failed main url is recorded too, to follow the outages
+	if page.err != nil {
+		fields["error"] = page.err.Error()
+	}
+
+	points = append(points, linePoint{
+		tags: tags(map[string]string{
+			"main_url":     mainUrl,
+			"type":         "page",
+			"status_class": statusClass(page.mainUrlStat.statusCode),
+		}),
+		fields: fields,
+		time:   page.mainUrlStat.startTime,
+	})
+
+	return points
+}
+
+// Status class of a status code, like 2xx
+func statusClass(statusCode int) string {
+	if statusCode == 0 {
+		return "error"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// Write the page points in line protocol
+func writeLineProtocol(w io.Writer, measurement string, page *pageResult, extraTags map[string]string) error {
+	for _, p := range pagePoints(page, extraTags) {
+		if _, err := io.WriteString(w, p.format(measurement)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the page points in line protocol to a file, - is stdout
+func writeLineProtocolFile(file string, measurement string, page *pageResult, extraTags map[string]string) error {
+	if file == "-" {
+		return writeLineProtocol(os.Stdout, measurement, page, extraTags)
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeLineProtocol(f, measurement, page, extraTags)
+}
+
+// Send statistic data to influxdb, with the v1 or v2 write api
+func sendstatsToInflux(config *influxConfig, page *pageResult) error {
+	var body bytes.Buffer
+	if err := writeLineProtocol(&body, config.measurement, page, config.tags); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(config.url)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"precision": {"ns"}}
+	switch config.version {
+	case 1:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		query.Set("db", config.database)
+		if config.username != "" {
+			query.Set("u", config.username)
+			query.Set("p", config.password)
+		}
+	case 2:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		query.Set("org", config.org)
+		query.Set("bucket", config.bucket)
+	default:
+		return fmt.Errorf("unknown influxdb version %d", config.version)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if config.version == 2 && config.token != "" {
+		req.Header.Set("Authorization", "Token "+config.token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println(red("Influxdb - error:\n"), err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influxdb write failed: %s %s", resp.Status, strings.TrimSpace(string(msg)))
 	}
+
+	return nil
 }
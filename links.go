@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Reasons an asset was found for, the other ones are the element names like img or script
+const (
+	reasonCss          = "css"
+	reasonPrefetch     = "prefetch"
+	reasonManifest     = "manifest"
+	reasonManifestIcon = "manifest icon"
+)
+
+// Links found in a html document
+type documentLinks struct {
+	assets   []string
+	frames   []string          // iframe, frame and object documents
+	prefetch []string          // prefetch hints, not part of the page load
+	reasons  map[string]string // why each asset or frame was found, like "img" or "preload font"
+	skipped  map[string]int    // count of links skipped by scheme
+}
+
+// Add an asset and the reason of its first reference
+func (l *documentLinks) add(assetUrl string, reason string) {
+	l.assets = append(l.assets, assetUrl)
+	l.setReason(assetUrl, reason)
+}
+
+func (l *documentLinks) setReason(assetUrl string, reason string) {
+	if _, ok := l.reasons[assetUrl]; !ok {
+		l.reasons[assetUrl] = reason
+	}
+}
+
+// Reason to fetch the href of a <link> element from its rel tokens, empty to ignore it.
+// With several tokens, like rel="stylesheet preload", the first fetched kind wins.
+func linkRelation(t *html.Token) (href string, reason string) {
+	var rel, as string
+	for _, a := range t.Attr {
+		switch a.Key {
+		case "rel":
+			rel = strings.ToLower(a.Val)
+		case "as":
+			as = strings.ToLower(strings.TrimSpace(a.Val))
+		case "href":
+			href = a.Val
+		}
+	}
+
+	tokens := make(map[string]bool)
+	for _, token := range strings.Fields(rel) {
+		tokens[token] = true
+	}
+	switch {
+	case tokens["stylesheet"]:
+		return href, "stylesheet"
+	case tokens["preload"] && as != "":
+		return href, "preload " + as
+	case tokens["preload"]:
+		return href, "preload"
+	case tokens["modulepreload"]:
+		return href, "modulepreload"
+	case tokens["icon"]:
+		return href, "icon"
+	}
+	for _, icon := range []string{"apple-touch-icon", "apple-touch-icon-precomposed", "mask-icon"} {
+		if tokens[icon] {
+			return href, icon
+		}
+	}
+	switch {
+	case tokens["manifest"]:
+		return href, reasonManifest
+	case tokens["prefetch"]:
+		return href, reasonPrefetch
+	}
+	return "", ""
+}
+
+// Count of the downloaded assets by reason
+func pageReasons(page *pageResult) map[string]int {
+	reasons := make(map[string]int)
+	for _, stat := range page.assetsStats {
+		if stat.reason != "" {
+			reasons[stat.reason]++
+		}
+	}
+	return reasons
+}
+
+// Web app manifest, only its icons are fetched
+type webManifest struct {
+	Icons []struct {
+		Src string `json:"src"`
+	} `json:"icons"`
+}
+
+// Extract the icons of a web app manifest, resolved against the manifest url
+func extractManifestIcons(body []byte, resolver *linkResolver) []string {
+	var manifest webManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil
+	}
+
+	var icons []string
+	for _, icon := range manifest.Icons {
+		if iconUrl, err := resolver.resolve(icon.Src); err == nil && iconUrl != "" {
+			icons = append(icons, iconUrl)
+		}
+	}
+	return icons
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Settings of a page fetch
+type pageConfig struct {
+	url                  string
+	headers              map[string]string
+	keyword              string
+	assetsAllowedDomains string
+	parallel             int
+	noDedup              bool
+	method               string // GET if empty
+	body                 []byte
+	contentType          string
+	assertions           assertConfig
+	certWarningDays      int
+	certCriticalDays     int
+	frameDepth           int  // nesting levels of iframe, frame and object documents to fetch, 0 for none
+	includePrefetch      bool // fetch the prefetch hints with the page
+	maxAssetSize         int  // abort the asset downloads over this size in bytes, 0 for no limit
+	hashAssets           bool // record the sha256 of the asset bodies
+	auditCompression     bool // estimate the gzip size of the uncompressed text responses
+	auditCache           bool // audit the caching headers of the responses
+	maxUncacheable       int  // warn over this percent of uncacheable bytes with auditCache
+	auditSecurity        bool // audit the security headers and the mixed content
+	viewport             viewport
+}
+
+// Result of a page fetch, assetsStats starts with the main url statistic
+type pageResult struct {
+	mainUrlStat      downloadStatistic
+	assets           []string
+	origins          map[string]assetOrigin // frame and reason of each asset, fetched or not
+	assetsStats      []downloadStatistic
+	failedStats      []downloadStatistic
+	duplicates       map[string]int
+	loops            map[string]int // references back to a resource they were found through, like an import loop
+	gstat            globalStatistic
+	body             []byte   // main url body
+	prefetch         []string // prefetch hints not fetched
+	auditCompression bool
+	auditCache       bool
+	auditSecurity    bool
+	failures         []assertFailure
+	err              error
+}
+
+// Fetch the main url and all its assets.
+// stream, if set, is called with each statistic as soon as it is downloaded.
+func fetchPage(config *pageConfig, client *http.Client, stream func(statType string, stat *downloadStatistic)) pageResult {
+	var (
+		result          pageResult
+		currentUrlIndex int
+		inFlight        int
+	)
+	result.duplicates = make(map[string]int)
+	result.loops = make(map[string]int)
+	result.auditCompression = config.auditCompression
+	result.auditCache = config.auditCache
+	result.auditSecurity = config.auditSecurity
+
+	// Channels
+	chUrls := make(chan downloadStatistic)
+	chFinished := make(chan bool)
+
+	//Set timer for global time
+	t0 := time.Now()
+
+	//Fetch the main url and get inner links
+	method := config.method
+	if method == "" {
+		method = "GET"
+	}
+	assets, mainUrlStat, body, err := fetchMainRequest(&mainRequest{
+		method:           method,
+		url:              config.url,
+		body:             config.body,
+		contentType:      config.contentType,
+		auditCompression: config.auditCompression,
+		viewport:         config.viewport,
+	}, client, config.headers, config.keyword)
+	mainUrlStat.err = err
+	result.mainUrlStat = mainUrlStat
+	result.body = body
+	result.assetsStats = append(result.assetsStats, mainUrlStat)
+
+	//handle main url error
+	if err != nil {
+		result.err = err
+		if stream != nil {
+			stream("main", &result.mainUrlStat)
+		}
+		return result
+	}
+
+	//check the main url response, all failures are kept
+	result.failures = config.assertions.check(&mainUrlStat, body)
+
+	//add main url response time
+	result.gstat.totalResponseSize += mainUrlStat.responseSize
+	result.gstat.totalEncodedSize += mainUrlStat.encodedSize
+	result.gstat.addSkippedLinks(mainUrlStat.skippedLinks)
+
+	//stream the main url
+	if stream != nil {
+		stream("main", &mainUrlStat)
+	}
+
+	//urls already queued, duplicates are fetched once
+	//and stylesheet imports loops are never followed.
+	//The frame of an url is the one of its first reference.
+	seen := map[string]bool{normalizeUrl(mainUrlStat.url): true}
+	origins := make(map[string]assetOrigin)
+	result.origins = origins
+	//a reference to the resource itself or to one it was found through closes a loop,
+	//it is never fetched again
+	closesLoop := func(assetUrl string, parent string) bool {
+		for u := parent; u != ""; u = origins[u].parent {
+			if u == assetUrl {
+				return true
+			}
+		}
+		return false
+	}
+	queue := func(assetUrl string, origin assetOrigin, dedup bool) {
+		assetUrl = normalizeUrl(assetUrl)
+		if closesLoop(assetUrl, origin.parent) {
+			result.loops[assetUrl]++
+			return
+		}
+		if seen[assetUrl] {
+			result.duplicates[assetUrl]++
+			if dedup {
+				return
+			}
+		} else {
+			origins[assetUrl] = origin
+		}
+		seen[assetUrl] = true
+		result.assets = append(result.assets, assetUrl)
+	}
+	//queue the links found in the page, a frame document, a stylesheet or a manifest,
+	//a frame document is the frame of its links
+	hints := make(map[string]bool)
+	queueLinks := func(stat *downloadStatistic, assets []string, dedup bool) {
+		frame, depth := stat.frame, 0
+		if stat.frameDepth > 0 {
+			frame, depth = stat.url, stat.frameDepth
+		}
+		parent := normalizeUrl(stat.url)
+		for _, assetUrl := range assets {
+			queue(assetUrl, assetOrigin{frame: frame, reason: stat.linkReasons[assetUrl], parent: parent}, dedup)
+		}
+		if depth < config.frameDepth {
+			for _, frameUrl := range stat.frames {
+				queue(frameUrl, assetOrigin{frame: frame, depth: depth + 1, reason: stat.linkReasons[frameUrl], parent: parent}, dedup)
+			}
+		}
+		for _, hintUrl := range stat.prefetch {
+			if config.includePrefetch {
+				queue(hintUrl, assetOrigin{frame: frame, reason: reasonPrefetch, parent: parent}, true)
+			} else if hintUrl = normalizeUrl(hintUrl); !hints[hintUrl] {
+				hints[hintUrl] = true
+				result.prefetch = append(result.prefetch, hintUrl)
+			}
+		}
+	}
+	queueLinks(&mainUrlStat, assets, !config.noDedup)
+
+	//Fetch the next inner links, limit calls count to max_concurrent_call
+	fetchNext := func() {
+		for currentUrlIndex < len(result.assets) && (config.parallel == 0 || inFlight < config.parallel) {
+			//fmt.Printf("%d/%d: call %s\n",currentUrlIndex, len(result.assets)-1, result.assets[currentUrlIndex])
+
+			assetUrl := result.assets[currentUrlIndex]
+			go fetchResource(assetUrl, origins[assetUrl], config, client, chUrls, chFinished)
+
+			currentUrlIndex++
+			inFlight++
+		}
+	}
+
+	//Fetch the firsts inner links
+	fetchNext()
+
+	// Subscribe to channels to wait for go routine
+	for c := 0; c < len(result.assets); {
+		select {
+		case stat := <-chUrls:
+			origin := origins[stat.url]
+			stat.frame, stat.frameDepth, stat.reason = origin.frame, origin.depth, origin.reason
+			if stream != nil {
+				stream("asset", &stat)
+			}
+			if stat.err != nil {
+				result.failedStats = append(result.failedStats, stat)
+				continue
+			}
+			result.assetsStats = append(result.assetsStats, stat)
+			result.gstat.totalResponseSize += stat.responseSize
+			result.gstat.totalEncodedSize += stat.encodedSize
+			result.gstat.addSkippedLinks(stat.skippedLinks)
+
+			//queue the assets found in the asset
+			queueLinks(&stat, stat.assets, true)
+		//got an asset, fetch next if exist
+		case <-chFinished:
+			c++
+			inFlight--
+			fetchNext()
+		}
+	}
+
+	close(chUrls)
+
+	//Set timer for global time
+	result.gstat.totalResponseTime += time.Since(t0)
+
+	//check the certificates of all the hosts
+	result.failures = append(result.failures, checkCertificates(&result, config.certWarningDays, config.certCriticalDays)...)
+	result.failures = append(result.failures, checkAssetSizes(&result, config.maxAssetSize)...)
+	if config.auditCache {
+		result.failures = append(result.failures, checkCacheability(&result, config.maxUncacheable)...)
+	}
+	if config.auditSecurity {
+		result.failures = append(result.failures, checkSecurity(&result)...)
+	}
+
+	return result
+}
+
+// Frame document an asset was found in, the nesting level of frame documents,
+// why the asset was found and the resource it was found in
+type assetOrigin struct {
+	frame  string
+	depth  int
+	reason string
+	parent string
+}
+
+// Normalize an url to compare assets: lower case scheme and host,
+// no default port, no fragment and at least a / path
+func normalizeUrl(assetUrl string) string {
+	u, err := url.Parse(assetUrl)
+	if err != nil {
+		return assetUrl
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if u.Path == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+
+	return u.String()
+}
+
+// Count the duplicate references
+func countDuplicates(duplicates map[string]int) (count int) {
+	for _, n := range duplicates {
+		count += n
+	}
+	return
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Proxy settings of the client. The environment proxies are used
+// unless overridden, a PAC file replaces both.
+type proxyConfig struct {
+	url     string     // http, https, socks5 or socks5h url, with the credentials if any
+	noProxy string     // comma separated hosts, domains and networks, * for none
+	pac     string     // PAC file path or url
+	script  *pacScript // pac already loaded, by the daemon
+}
+
+// Build the proxy selection of the transport
+func newProxyFunc(config *proxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	var proxyFunc func(*url.URL) (*url.URL, error)
+
+	if config.script != nil {
+		proxyFunc = config.script.proxyForUrl
+	} else if config.pac != "" {
+		pac, err := loadPac(config.pac)
+		if err != nil {
+			return nil, err
+		}
+		proxyFunc = pac.proxyForUrl
+	} else {
+		env := httpproxy.FromEnvironment()
+		if config.url != "" {
+			u, err := url.Parse(config.url)
+			if err != nil {
+				return nil, fmt.Errorf("bad proxy url %s: %v", redactProxyUrl(config.url), err)
+			}
+			switch u.Scheme {
+			case "http", "https", "socks5", "socks5h":
+			default:
+				return nil, errors.New("unsupported proxy scheme " + u.Scheme)
+			}
+			env.HTTPProxy = config.url
+			env.HTTPSProxy = config.url
+		}
+		if config.noProxy != "" {
+			env.NoProxy = config.noProxy
+		}
+		proxyFunc = env.ProxyFunc()
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxyFunc(req.URL)
+		if u != nil {
+			if p, ok := req.Context().Value(phaseTimerKey{}).(*phaseTimer); ok {
+				p.setProxy(u.Host)
+			}
+		}
+		return u, err
+	}, nil
+}
+
+// Hide the password of a proxy url
+func redactProxyUrl(proxyUrl string) string {
+	u, err := url.Parse(proxyUrl)
+	if err != nil || u.User == nil {
+		return proxyUrl
+	}
+	return u.Redacted()
+}
+
+// A loaded PAC file. Its javascript runtime is not safe for concurrent use.
+// The results are not cached, FindProxyForURL can depend on the path, the time or the DNS.
+type pacScript struct {
+	mu   sync.Mutex
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+// Load a PAC file from a path or an http url
+func loadPac(location string) (*pacScript, error) {
+	var source []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("PAC file %s: status %d", location, resp.StatusCode)
+		}
+		source, err = ioutil.ReadAll(resp.Body)
+	} else {
+		source, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pac := &pacScript{vm: goja.New()}
+	pac.defineHelpers()
+	if _, err := pac.vm.RunScript(location, string(source)); err != nil {
+		return nil, fmt.Errorf("PAC file %s: %v", location, err)
+	}
+	find, ok := goja.AssertFunction(pac.vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("PAC file %s: FindProxyForURL is not defined", location)
+	}
+	pac.find = find
+	return pac, nil
+}
+
+// Proxy of an url, nil to connect directly
+func (pac *pacScript) proxyForUrl(u *url.URL) (*url.URL, error) {
+	pac.mu.Lock()
+	defer pac.mu.Unlock()
+
+	//https paths are hidden from the PAC file like browsers do
+	pacUrl := u.String()
+	if u.Scheme == "https" {
+		pacUrl = u.Scheme + "://" + u.Host + "/"
+	}
+	result, err := pac.find(goja.Undefined(), pac.vm.ToValue(pacUrl), pac.vm.ToValue(u.Hostname()))
+	if err != nil {
+		return nil, fmt.Errorf("FindProxyForURL(%s): %v", pacUrl, err)
+	}
+	return parsePacResult(result.String())
+}
+
+// Load the PAC files of the targets once, their checks share the scripts
+func loadTargetsPac(targets []targetConfig) error {
+	scripts := make(map[string]*pacScript)
+	for i := range targets {
+		location := targets[i].ProxyPac
+		if location == "" {
+			continue
+		}
+		if _, ok := scripts[location]; !ok {
+			pac, err := loadPac(location)
+			if err != nil {
+				return fmt.Errorf("target %s: %v", targets[i].Name, err)
+			}
+			scripts[location] = pac
+		}
+		targets[i].pacScript = scripts[location]
+	}
+	return nil
+}
+
+// Parse a FindProxyForURL result like "PROXY a:3128; SOCKS5 b:1080; DIRECT",
+// the first supported entry is used. SOCKS4 proxies are rejected, SOCKS is taken as SOCKS5.
+func parsePacResult(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		case "SOCKS4":
+			return nil, fmt.Errorf("SOCKS4 proxy %s is not supported", strings.Join(fields[1:], " "))
+		default:
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("bad PAC result %q", result)
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("no supported proxy in PAC result %q", result)
+}
+
+// Define the PAC helper functions
+func (pac *pacScript) defineHelpers() {
+	vm := pac.vm
+
+	resolve := func(host string) net.IP {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil || len(ips) == 0 {
+			return nil
+		}
+		return ips[0]
+	}
+
+	vm.Set("isPlainHostName", func(host string) bool {
+		return !strings.Contains(host, ".")
+	})
+	vm.Set("dnsDomainIs", func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	})
+	vm.Set("localHostOrDomainIs", func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		return host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."))
+	})
+	vm.Set("isResolvable", func(host string) bool {
+		return resolve(host) != nil
+	})
+	vm.Set("isInNet", func(host, pattern, mask string) bool {
+		ip, network, netmask := resolve(host), net.ParseIP(pattern), net.ParseIP(mask)
+		if ip == nil || network == nil || netmask == nil {
+			return false
+		}
+		m := net.IPMask(netmask.To4())
+		return ip.To4() != nil && ip.To4().Mask(m).Equal(network.To4().Mask(m))
+	})
+	vm.Set("dnsResolve", func(host string) interface{} {
+		if ip := resolve(host); ip != nil {
+			return ip.String()
+		}
+		return nil
+	})
+	vm.Set("myIpAddress", func() string {
+		//no packet is sent, the route gives the local address
+		conn, err := net.Dial("udp", "192.0.2.1:53")
+		if err != nil {
+			return "127.0.0.1"
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	})
+	vm.Set("dnsDomainLevels", func(host string) int {
+		return strings.Count(host, ".")
+	})
+	vm.Set("shExpMatch", func(s, exp string) bool {
+		pattern := regexp.QuoteMeta(exp)
+		pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+		pattern = strings.ReplaceAll(pattern, `\?`, ".")
+		matched, _ := regexp.MatchString("^"+pattern+"$", s)
+		return matched
+	})
+	vm.Set("weekdayRange", func(call goja.FunctionCall) goja.Value {
+		days := []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+		args, now := pacTimeArgs(call)
+		day := func(name string) int {
+			for i, d := range days {
+				if d == strings.ToUpper(name) {
+					return i
+				}
+			}
+			return -1
+		}
+		if len(args) == 0 {
+			return vm.ToValue(false)
+		}
+		first, last := day(args[0]), day(args[0])
+		if len(args) > 1 {
+			last = day(args[1])
+		}
+		wd := int(now.Weekday())
+		if first <= last {
+			return vm.ToValue(wd >= first && wd <= last)
+		}
+		return vm.ToValue(wd >= first || wd <= last)
+	})
+	vm.Set("timeRange", func(call goja.FunctionCall) goja.Value {
+		//only the hour forms, timeRange(hour) and timeRange(hour1, hour2)
+		args, now := pacTimeArgs(call)
+		var hours []int
+		for _, a := range args {
+			var h int
+			fmt.Sscan(a, &h)
+			hours = append(hours, h)
+		}
+		switch len(hours) {
+		case 1:
+			return vm.ToValue(now.Hour() == hours[0])
+		case 2:
+			if hours[0] <= hours[1] {
+				return vm.ToValue(now.Hour() >= hours[0] && now.Hour() < hours[1])
+			}
+			return vm.ToValue(now.Hour() >= hours[0] || now.Hour() < hours[1])
+		}
+		return vm.ToValue(false)
+	})
+}
+
+// Arguments of a PAC time function without the trailing "GMT", and the time to compare to
+func pacTimeArgs(call goja.FunctionCall) ([]string, time.Time) {
+	now := time.Now()
+	var args []string
+	for _, a := range call.Arguments {
+		args = append(args, a.String())
+	}
+	if len(args) > 0 && strings.ToUpper(args[len(args)-1]) == "GMT" {
+		args = args[:len(args)-1]
+		now = now.UTC()
+	}
+	return args, now
+}
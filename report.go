@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Output formats
+const (
+	outputText   = "text"
+	outputJson   = "json"
+	outputNdjson = "ndjson"
+)
+
+// Version of the json report schema, bump it on incompatible changes
+const reportSchemaVersion = 2
+
+// Json report of a page fetch
+type report struct {
+	Type          string       `json:"type,omitempty"`
+	Target        string       `json:"target,omitempty"`
+	SchemaVersion int          `json:"schemaVersion"`
+	ElmoVersion   string       `json:"elmoVersion"`
+	Config        reportConfig `json:"config"`
+	reportView
+	RepeatView *reportView `json:"repeatView,omitempty"`
+}
+
+// Json report of the targets of a configuration file
+type targetsReport struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	ElmoVersion   string    `json:"elmoVersion"`
+	Targets       []*report `json:"targets"`
+}
+
+// Statistics of one view of the page
+type reportView struct {
+	Main         *reportStat            `json:"main,omitempty"`
+	Assets       []reportStat           `json:"assets,omitempty"`
+	Failed       []reportStat           `json:"failed,omitempty"`
+	Duplicates   map[string]int         `json:"duplicates,omitempty"`
+	Loops        map[string]int         `json:"referenceLoops,omitempty"`
+	Failures     []reportFailure        `json:"assertionFailures,omitempty"`
+	Certificates map[string]reportChain `json:"certificates,omitempty"`
+	Frames       []reportFrame          `json:"frames,omitempty"`
+	Prefetch     []string               `json:"prefetchHints,omitempty"`
+	Compression  *reportCompression     `json:"compressionAudit,omitempty"`
+	CacheAudit   *reportCacheAudit      `json:"cacheAudit,omitempty"`
+	Security     *reportSecurity        `json:"securityAudit,omitempty"`
+	Totals       reportTotals           `json:"totals"`
+}
+
+// TLS connection of a response
+type reportTls struct {
+	Version     string `json:"version"`
+	Cipher      string `json:"cipher"`
+	Alpn        string `json:"alpn,omitempty"`
+	OcspStapled bool   `json:"ocspStapled"`
+}
+
+// Peer certificate chain of a host, leaf first
+type reportChain struct {
+	reportTls
+	Certificates []reportCertificate `json:"chain"`
+}
+
+type reportCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Sans      []string  `json:"sans,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	KeyType   string    `json:"keyType"`
+}
+
+// A failed assertion
+type reportFailure struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// Effective configuration of the run
+type reportConfig struct {
+	Url                   string            `json:"url"`
+	Keyword               string            `json:"keyword,omitempty"`
+	Headers               map[string]string `json:"headers,omitempty"`
+	Parallel              int               `json:"parallel"`
+	ConnectTimeout        int               `json:"connectTimeoutMs"`
+	TlsTimeout            int               `json:"tlsTimeoutMs"`
+	ResponseHeaderTimeout int               `json:"responseHeaderTimeoutMs"`
+	Timeout               int               `json:"timeoutMs"`
+	Resolve               []string          `json:"resolve,omitempty"`
+	DnsServer             string            `json:"dnsServer,omitempty"`
+	IpVersion             int               `json:"ipVersion,omitempty"`
+	AssetsAllowedDomains  string            `json:"assetsAllowedDomains,omitempty"`
+	ViewportWidth         int               `json:"viewportWidth,omitempty"`
+	DevicePixelRatio      float64           `json:"devicePixelRatio,omitempty"`
+	NoDedup               bool              `json:"noDedup,omitempty"`
+	RepeatView            bool              `json:"repeatView,omitempty"`
+	CaFile                string            `json:"caFile,omitempty"`
+	ClientCertificate     string            `json:"clientCertificate,omitempty"`
+	Sni                   string            `json:"sni,omitempty"`
+	TlsMinVersion         string            `json:"tlsMinVersion,omitempty"`
+	TlsMaxVersion         string            `json:"tlsMaxVersion,omitempty"`
+	TlsCiphers            string            `json:"tlsCiphers,omitempty"`
+	Insecure              bool              `json:"insecure"`
+	HttpVersion           string            `json:"httpVersion,omitempty"`
+	Proxy                 string            `json:"proxy,omitempty"`
+	NoProxy               string            `json:"noProxy,omitempty"`
+	ProxyPac              string            `json:"proxyPac,omitempty"`
+	FrameDepth            int               `json:"frameDepth,omitempty"`
+	IncludePrefetch       bool              `json:"includePrefetch,omitempty"`
+	MaxAssetSize          int               `json:"maxAssetSize,omitempty"`
+	HashAssets            bool              `json:"hashAssets,omitempty"`
+	AuditCompression      bool              `json:"auditCompression,omitempty"`
+	AuditCache            bool              `json:"auditCache,omitempty"`
+	MaxUncacheable        int               `json:"maxUncacheable,omitempty"`
+	AuditSecurity         bool              `json:"auditSecurity,omitempty"`
+}
+
+type reportStat struct {
+	Type         string        `json:"type,omitempty"`
+	Target       string        `json:"target,omitempty"`
+	Url          string        `json:"url"`
+	StartTime    *time.Time    `json:"startTime,omitempty"`
+	StatusCode   int           `json:"statusCode,omitempty"`
+	Protocol     string        `json:"protocol,omitempty"`
+	RemoteAddr   string        `json:"remoteAddr,omitempty"`
+	Proxy        string        `json:"proxy,omitempty"`
+	ResponseTime float64       `json:"responseTimeMs"`
+	ResponseSize int           `json:"responseSize"`
+	EncodedSize  int           `json:"encodedSize"`
+	Encoding     string        `json:"contentEncoding,omitempty"`
+	GzipSize     int           `json:"gzipSize,omitempty"`
+	Timings      reportTimings `json:"timings"`
+	ConnReused   bool          `json:"connReused"`
+	CacheStatus  string        `json:"cacheStatus,omitempty"`
+	Tls          *reportTls    `json:"tls,omitempty"`
+	Dns          *reportDns    `json:"dns,omitempty"`
+	Frame        string        `json:"frame,omitempty"`
+	FrameDepth   int           `json:"frameDepth,omitempty"`
+	Reason       string        `json:"reason,omitempty"`
+	Oversized    bool          `json:"oversized,omitempty"`
+	Sha256       string        `json:"sha256,omitempty"`
+	Cache        *reportCache  `json:"cache,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// Text responses served without compression, with --audit-compression
+type reportCompression struct {
+	Uncompressed []reportUncompressed `json:"uncompressed"`
+	Savings      int                  `json:"savings"`
+}
+
+type reportUncompressed struct {
+	Url          string `json:"url"`
+	ContentType  string `json:"contentType"`
+	ResponseSize int    `json:"responseSize"`
+	GzipSize     int    `json:"gzipSize"`
+}
+
+// Caching headers of a response, with --audit-cache
+type reportCache struct {
+	CacheControl  string `json:"cacheControl,omitempty"`
+	Expires       string `json:"expires,omitempty"`
+	ETag          string `json:"etag,omitempty"`
+	LastModified  string `json:"lastModified,omitempty"`
+	Age           string `json:"age,omitempty"`
+	Vary          string `json:"vary,omitempty"`
+	Ttl           int    `json:"ttlSeconds"`
+	Uncacheable   bool   `json:"uncacheable"`
+	Fingerprinted bool   `json:"fingerprinted"`
+}
+
+// Caching issues of a page, with --audit-cache
+type reportCacheAudit struct {
+	Issues          []reportCacheIssue `json:"issues"`
+	UncacheableSize int                `json:"uncacheableSize"`
+	TotalSize       int                `json:"totalSize"`
+}
+
+type reportCacheIssue struct {
+	Url   string `json:"url"`
+	Issue string `json:"issue"`
+	Ttl   int    `json:"ttlSeconds"`
+}
+
+// Security headers of the main url and mixed content, with --audit-security
+type reportSecurity struct {
+	Headers      []reportSecurityHeader `json:"headers"`
+	MixedContent []reportMixedContent   `json:"mixedContent"`
+}
+
+type reportSecurityHeader struct {
+	Name    string `json:"name"`
+	Value   string `json:"value,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type reportMixedContent struct {
+	Url      string `json:"url"`
+	Document string `json:"document"`
+	Reason   string `json:"reason,omitempty"`
+	Active   bool   `json:"active"`
+}
+
+// A frame document, frame is its parent frame if nested
+type reportFrame struct {
+	Url          string `json:"url"`
+	Frame        string `json:"frame,omitempty"`
+	Depth        int    `json:"depth"`
+	Assets       int    `json:"assets"`
+	Failed       int    `json:"failed"`
+	ResponseSize int    `json:"responseSize"`
+}
+
+// DNS resolution of a request host
+type reportDns struct {
+	Server  string            `json:"server"`
+	Addrs   []string          `json:"addresses"`
+	Records []reportDnsRecord `json:"records,omitempty"`
+}
+
+type reportDnsRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Ttl  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// Request phases in ms
+type reportTimings struct {
+	Dns      float64 `json:"dnsMs"`
+	Proxy    float64 `json:"proxyMs,omitempty"`
+	Connect  float64 `json:"connectMs"`
+	Tls      float64 `json:"tlsMs"`
+	Send     float64 `json:"sendMs"`
+	Ttfb     float64 `json:"ttfbMs"`
+	Download float64 `json:"downloadMs"`
+}
+
+type reportTotals struct {
+	ResponseTime float64        `json:"responseTimeMs"`
+	ResponseSize int            `json:"responseSize"`
+	EncodedSize  int            `json:"encodedSize"`
+	Downloaded   int            `json:"downloaded"`
+	Failed       int            `json:"failed"`
+	SkippedLinks map[string]int `json:"skippedLinks,omitempty"`
+	Duplicates   int            `json:"duplicateReferences"`
+	Loops        int            `json:"loopReferences"`
+	CacheHits    int            `json:"cacheHits"`
+	Revalidated  int            `json:"cacheRevalidated"`
+	Protocols    map[string]int `json:"protocols,omitempty"`
+	Connections  int            `json:"connections"`
+	MaxStreams   int            `json:"maxConcurrentRequestsPerConnection"`
+	Reasons      map[string]int `json:"reasons,omitempty"`
+}
+
+// Build the json report of a page fetch, with its repeat view if any
+func newReport(target *targetConfig, page *pageResult, repeatPage *pageResult) *report {
+	r := &report{
+		Target:        target.Name,
+		SchemaVersion: reportSchemaVersion,
+		ElmoVersion:   VERSION,
+		Config:        newReportConfig(target),
+		reportView:    newReportView(page),
+	}
+
+	if repeatPage != nil {
+		view := newReportView(repeatPage)
+		r.RepeatView = &view
+	}
+
+	return r
+}
+
+// Build the statistics of one page fetch
+func newReportView(page *pageResult) reportView {
+	gstat := page.gstat
+	v := reportView{
+		Duplicates: page.duplicates,
+		Loops:      page.loops,
+		Prefetch:   page.prefetch,
+		Totals: reportTotals{
+			ResponseTime: msec(gstat.totalResponseTime),
+			ResponseSize: gstat.totalResponseSize,
+			EncodedSize:  gstat.totalEncodedSize,
+			Failed:       len(page.failedStats),
+			SkippedLinks: gstat.skippedLinks,
+			Duplicates:   countDuplicates(page.duplicates),
+			Loops:        countDuplicates(page.loops),
+		},
+	}
+
+	for _, f := range page.failures {
+		v.Failures = append(v.Failures, reportFailure{Kind: f.kind, Message: f.message, Status: nagiosStatusName(f.status)})
+	}
+
+	for host, info := range pageCertificates(page) {
+		if v.Certificates == nil {
+			v.Certificates = make(map[string]reportChain)
+		}
+		chain := reportChain{reportTls: reportTls{Version: info.version, Cipher: info.cipher, Alpn: info.alpn, OcspStapled: info.ocspStapled}}
+		for _, cert := range info.certificates {
+			chain.Certificates = append(chain.Certificates, reportCertificate{
+				Subject:   cert.subject,
+				Issuer:    cert.issuer,
+				Sans:      cert.sans,
+				NotBefore: cert.notBefore,
+				NotAfter:  cert.notAfter,
+				KeyType:   cert.keyType,
+			})
+		}
+		v.Certificates[host] = chain
+	}
+
+	for _, f := range pageFrames(page) {
+		v.Frames = append(v.Frames, reportFrame{Url: f.stat.url, Frame: f.stat.frame, Depth: f.stat.frameDepth,
+			Assets: f.assets, Failed: f.failed, ResponseSize: f.responseSize})
+	}
+
+	main := newReportStat(&page.mainUrlStat)
+	v.Main = &main
+
+	// the first statistic is the main url
+	for i := 1; i < len(page.assetsStats); i++ {
+		v.Assets = append(v.Assets, newReportStat(&page.assetsStats[i]))
+	}
+	for i := range page.failedStats {
+		v.Failed = append(v.Failed, newReportStat(&page.failedStats[i]))
+	}
+
+	v.Totals.Downloaded = len(v.Assets)
+	usage := pageConnectionUsage(page.assetsStats)
+	v.Totals.Connections = usage.connections
+	v.Totals.MaxStreams = usage.maxConcurrent
+	if len(usage.protocols) > 0 {
+		v.Totals.Protocols = usage.protocols
+	}
+	if reasons := pageReasons(page); len(reasons) > 0 {
+		v.Totals.Reasons = reasons
+	}
+	if page.auditCompression {
+		issues, savings := auditCompression(page)
+		v.Compression = &reportCompression{Uncompressed: []reportUncompressed{}, Savings: savings}
+		for _, issue := range issues {
+			v.Compression.Uncompressed = append(v.Compression.Uncompressed, reportUncompressed{
+				Url: issue.url, ContentType: issue.contentType, ResponseSize: issue.size, GzipSize: issue.gzipSize})
+		}
+	}
+	if page.auditCache {
+		main.Cache = newReportCache(&page.mainUrlStat)
+		for i := range v.Assets {
+			v.Assets[i].Cache = newReportCache(&page.assetsStats[i+1])
+		}
+		issues, uncacheable, total := auditCache(page)
+		v.CacheAudit = &reportCacheAudit{Issues: []reportCacheIssue{}, UncacheableSize: uncacheable, TotalSize: total}
+		for _, issue := range issues {
+			v.CacheAudit.Issues = append(v.CacheAudit.Issues, reportCacheIssue{
+				Url: issue.url, Issue: issue.message, Ttl: int(issue.ttl.Seconds())})
+		}
+	}
+	if page.auditSecurity {
+		v.Security = &reportSecurity{Headers: []reportSecurityHeader{}, MixedContent: []reportMixedContent{}}
+		for _, h := range auditSecurityHeaders(&page.mainUrlStat) {
+			v.Security.Headers = append(v.Security.Headers, reportSecurityHeader{Name: h.name, Value: h.value, Status: h.status, Message: h.message})
+		}
+		for _, m := range auditMixedContent(page) {
+			v.Security.MixedContent = append(v.Security.MixedContent, reportMixedContent{Url: m.url, Document: m.document, Reason: m.reason, Active: m.active})
+		}
+	}
+	for _, stat := range page.assetsStats {
+		switch stat.cacheStatus {
+		case cacheHit:
+			v.Totals.CacheHits++
+		case cacheRevalidated:
+			v.Totals.Revalidated++
+		}
+	}
+
+	return v
+}
+
+// Effective configuration of a target
+func newReportConfig(target *targetConfig) reportConfig {
+	config := reportConfig{
+		Url:                   target.Url,
+		Keyword:               target.Keyword,
+		Headers:               target.requestHeaders(),
+		Parallel:              target.Parallel,
+		ConnectTimeout:        target.ConnectTimeout,
+		TlsTimeout:            target.TlsTimeout,
+		ResponseHeaderTimeout: target.ResponseHeaderTimeout,
+		Timeout:               target.clientTimeout(),
+		Resolve:               target.Resolve,
+		DnsServer:             target.DnsServer,
+		IpVersion:             target.IpVersion,
+		AssetsAllowedDomains:  target.AssetsAllowedDomains,
+		ViewportWidth:         target.ViewportWidth,
+		NoDedup:               target.NoDedup,
+		RepeatView:            target.RepeatView,
+		CaFile:                target.CaFile,
+		ClientCertificate:     target.CertFile,
+		Sni:                   target.Sni,
+		TlsMinVersion:         target.TlsMinVersion,
+		TlsMaxVersion:         target.TlsMaxVersion,
+		TlsCiphers:            target.TlsCiphers,
+		Insecure:              target.Insecure,
+		HttpVersion:           target.HttpVersion,
+		Proxy:                 redactProxyUrl(target.Proxy),
+		NoProxy:               target.NoProxy,
+		ProxyPac:              target.ProxyPac,
+		FrameDepth:            target.FrameDepth,
+		IncludePrefetch:       target.IncludePrefetch,
+		MaxAssetSize:          target.MaxAssetSize,
+		HashAssets:            target.HashAssets,
+		AuditCompression:      target.AuditCompression,
+		AuditSecurity:         target.AuditSecurity,
+	}
+	if target.AuditCache {
+		config.AuditCache, config.MaxUncacheable = true, target.MaxUncacheable
+	}
+	if target.Pkcs12File != "" {
+		config.ClientCertificate = target.Pkcs12File
+	}
+	if target.ViewportWidth > 0 {
+		config.DevicePixelRatio = target.viewport().dpr
+	}
+
+	return config
+}
+
+// Convert a downloadStatistic to its json form
+func newReportStat(stat *downloadStatistic) reportStat {
+	r := reportStat{
+		Url:          stat.url,
+		StatusCode:   stat.statusCode,
+		Protocol:     stat.proto,
+		RemoteAddr:   stat.remoteAddr,
+		Proxy:        stat.proxy,
+		ResponseTime: msec(stat.responseTime),
+		ResponseSize: stat.responseSize,
+		EncodedSize:  stat.encodedSize,
+		Encoding:     stat.contentEncoding,
+		GzipSize:     stat.gzipSize,
+		Timings: reportTimings{
+			Dns:      msec(stat.dnsTime),
+			Proxy:    msec(stat.proxyTime),
+			Connect:  msec(stat.connectTime),
+			Tls:      msec(stat.tlsTime),
+			Send:     msec(stat.sendTime),
+			Ttfb:     msec(stat.ttfb),
+			Download: msec(stat.downloadTime),
+		},
+		ConnReused:  stat.connReused,
+		CacheStatus: stat.cacheStatus,
+		Frame:       stat.frame,
+		FrameDepth:  stat.frameDepth,
+		Reason:      stat.reason,
+		Oversized:   stat.oversized,
+		Sha256:      stat.sha256,
+	}
+	if !stat.startTime.IsZero() {
+		r.StartTime = &stat.startTime
+	}
+	if stat.tls != nil {
+		r.Tls = &reportTls{Version: stat.tls.version, Cipher: stat.tls.cipher, Alpn: stat.tls.alpn, OcspStapled: stat.tls.ocspStapled}
+	}
+	if stat.dns != nil {
+		r.Dns = &reportDns{Server: stat.dns.server, Addrs: stat.dns.addrs}
+		for _, record := range stat.dns.records {
+			r.Dns.Records = append(r.Dns.Records, reportDnsRecord{Name: record.name, Type: record.rtype, Ttl: record.ttl, Data: record.data})
+		}
+	}
+	if stat.err != nil {
+		r.Error = stat.err.Error()
+	}
+	return r
+}
+
+func newReportCache(stat *downloadStatistic) *reportCache {
+	p := newCachePolicy(stat)
+	return &reportCache{
+		CacheControl:  p.cacheControl,
+		Expires:       p.expires,
+		ETag:          p.etag,
+		LastModified:  p.lastModified,
+		Age:           p.age,
+		Vary:          p.vary,
+		Ttl:           int(p.ttl.Seconds()),
+		Uncacheable:   p.uncacheable(),
+		Fingerprinted: p.fingerprinted,
+	}
+}
+
+// Write a single statistic as a ndjson line, target is empty for a single page
+func writeNdjsonStat(w io.Writer, target string, statType string, stat *downloadStatistic) error {
+	r := newReportStat(stat)
+	r.Type = statType
+	r.Target = target
+	return json.NewEncoder(w).Encode(r)
+}
+
+// Write the report in the selected output format,
+// in ndjson mode the statistics are already streamed so only the summary is written
+func writeReport(w io.Writer, r *report) error {
+	if outputFormat == outputNdjson {
+		summary := report{
+			Type:          "summary",
+			Target:        r.Target,
+			SchemaVersion: r.SchemaVersion,
+			ElmoVersion:   r.ElmoVersion,
+			Config:        r.Config,
+		}
+		summary.Duplicates = r.Duplicates
+		summary.Loops = r.Loops
+		summary.Failures = r.Failures
+		summary.Totals = r.Totals
+		if r.RepeatView != nil {
+			summary.RepeatView = &reportView{Duplicates: r.RepeatView.Duplicates, Loops: r.RepeatView.Loops, Totals: r.RepeatView.Totals}
+		}
+		return json.NewEncoder(w).Encode(summary)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Write the combined report of the targets,
+// in ndjson mode one summary line is written per target
+func writeTargetsReport(w io.Writer, results []*targetResult) error {
+	tr := targetsReport{SchemaVersion: reportSchemaVersion, ElmoVersion: VERSION}
+	for _, r := range results {
+		tr.Targets = append(tr.Targets, newReport(r.target, &r.page, r.repeatPage))
+	}
+
+	if outputFormat == outputNdjson {
+		for _, r := range tr.Targets {
+			if err := writeReport(w, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tr)
+}
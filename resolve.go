@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Resolve asset links against the document base url
+// and count the links which can not be fetched by scheme
+type linkResolver struct {
+	base    *url.URL
+	skipped map[string]int
+}
+
+func newLinkResolver(base *url.URL) *linkResolver {
+	return &linkResolver{base: base, skipped: make(map[string]int)}
+}
+
+// Set the base url from a <base href> element, resolved against the current base
+func (r *linkResolver) setBase(href string) {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return
+	}
+	r.base = r.base.ResolveReference(u)
+}
+
+// Resolve a link to an absolute http(s) url,
+// data:, javascript:, mailto:, blob: and other schemes are skipped and counted
+func (r *linkResolver) resolve(link string) (string, error) {
+	link = strings.TrimSpace(link)
+	if link == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	u = r.base.ResolveReference(u)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		r.skipped[u.Scheme]++
+		return "", nil
+	}
+
+	// the fragment is never sent to the server
+	u.Fragment = ""
+	return u.String(), nil
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/andybalholm/cascadia"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+	"gopkg.in/yaml.v3"
+)
+
+// A multi-step transaction, like a login then an account page
+type scenarioConfig struct {
+	Name      string            `yaml:"name" toml:"name"`
+	Variables map[string]string `yaml:"variables" toml:"variables"`
+	Steps     []scenarioStep    `yaml:"steps" toml:"steps"`
+}
+
+// A scenario step. Strings can use {{variable}} and {{env.NAME}}.
+type scenarioStep struct {
+	Name         string                 `yaml:"name" toml:"name"`
+	Method       string                 `yaml:"method" toml:"method"`
+	Url          string                 `yaml:"url" toml:"url"` // relative to the previous step url
+	Headers      map[string]string      `yaml:"headers" toml:"headers"`
+	Form         map[string]string      `yaml:"form" toml:"form"`
+	Json         interface{}            `yaml:"json" toml:"json"`
+	Keyword      string                 `yaml:"keyword" toml:"keyword"`
+	ExpectStatus int                    `yaml:"expect_status" toml:"expect_status"` // any status below 400 if unset
+	Assert       assertConfig           `yaml:"assert" toml:"assert"`
+	Extract      map[string]extractRule `yaml:"extract" toml:"extract"`
+}
+
+// Extraction of a variable from a step response, only one source is used
+type extractRule struct {
+	Regex  string `yaml:"regex" toml:"regex"` // first group, or the whole match
+	Css    string `yaml:"css" toml:"css"`     // text of the first element, or its attr
+	Attr   string `yaml:"attr" toml:"attr"`
+	Json   string `yaml:"json" toml:"json"` // dotted path like data.items.0.id
+	Header string `yaml:"header" toml:"header"`
+}
+
+// Result of a scenario step
+type stepResult struct {
+	target *targetConfig // the step as a target, with its variables expanded
+	page   pageResult
+	err    error
+}
+
+// Result of a scenario
+type scenarioResult struct {
+	name     string
+	steps    []stepResult
+	total    int
+	duration time.Duration
+	size     int
+	status   int
+	err      error
+}
+
+var scenarioVariableRegexp = regexp.MustCompile(`\{\{\s*([\w.-]+)\s*\}\}`)
+
+// Load a yaml or toml scenario file, toml is chosen by the .toml extension
+func loadScenario(path string) (*scenarioConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scenario := &scenarioConfig{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, scenario)
+	} else {
+		err = yaml.Unmarshal(data, scenario)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if len(scenario.Steps) == 0 {
+		return nil, fmt.Errorf("%s: no steps", path)
+	}
+	if scenario.Name == "" {
+		scenario.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	for i, step := range scenario.Steps {
+		if step.Url == "" {
+			return nil, fmt.Errorf("%s: step %d has no url", path, i+1)
+		}
+		if step.Name == "" {
+			scenario.Steps[i].Name = "step" + strconv.Itoa(i+1)
+		}
+		if err := step.Assert.validate(); err != nil {
+			return nil, fmt.Errorf("%s: step %d: %v", path, i+1, err)
+		}
+		for name, rule := range step.Extract {
+			if rule.Regex != "" {
+				if _, err := regexp.Compile(rule.Regex); err != nil {
+					return nil, fmt.Errorf("%s: step %d: extract %s: %v", path, i+1, name, err)
+				}
+			}
+			if rule.Css != "" {
+				if _, err := cascadia.Compile(rule.Css); err != nil {
+					return nil, fmt.Errorf("%s: step %d: extract %s: %v", path, i+1, name, err)
+				}
+			}
+		}
+	}
+
+	return scenario, nil
+}
+
+// Replace the {{variable}} and {{env.NAME}} references of a string
+func expandVariables(s string, variables map[string]string) (string, error) {
+	var err error
+	expanded := scenarioVariableRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := scenarioVariableRegexp.FindStringSubmatch(ref)[1]
+		if env, ok := strings.CutPrefix(name, "env."); ok {
+			return os.Getenv(env)
+		}
+		v, ok := variables[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined variable %s", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// Replace the variables in the strings of a json value
+func expandJsonVariables(value interface{}, variables map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expandVariables(v, variables)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			expanded, err := expandJsonVariables(item, variables)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = expanded
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded, err := expandJsonVariables(item, variables)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = expanded
+		}
+		return l, nil
+	}
+	return value, nil
+}
+
+// Build the page fetch settings of a step
+func (step *scenarioStep) pageConfig(defaults *targetConfig, previousUrl string, variables map[string]string) (*pageConfig, error) {
+	stepUrl, err := expandVariables(step.Url, variables)
+	if err != nil {
+		return nil, err
+	}
+	if previousUrl != "" {
+		base, err := url.Parse(previousUrl)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := url.Parse(stepUrl)
+		if err != nil {
+			return nil, err
+		}
+		stepUrl = base.ResolveReference(ref).String()
+	}
+
+	config := defaults.pageConfig()
+	config.url = stepUrl
+	config.assertions = step.Assert
+	config.method = strings.ToUpper(step.Method)
+	if step.Keyword != "" {
+		config.keyword, err = expandVariables(step.Keyword, variables)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range step.Headers {
+		if config.headers[k], err = expandVariables(v, variables); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case step.Form != nil:
+		form := url.Values{}
+		for k, v := range step.Form {
+			value, err := expandVariables(v, variables)
+			if err != nil {
+				return nil, err
+			}
+			form.Set(k, value)
+		}
+		config.body = []byte(form.Encode())
+		config.contentType = "application/x-www-form-urlencoded"
+	case step.Json != nil:
+		value, err := expandJsonVariables(step.Json, variables)
+		if err != nil {
+			return nil, err
+		}
+		if config.body, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+		config.contentType = "application/json"
+	}
+	if config.method == "" {
+		config.method = "GET"
+		if config.body != nil {
+			config.method = "POST"
+		}
+	}
+
+	return config, nil
+}
+
+// Check the status code of a step response
+func (step *scenarioStep) checkStatus(statusCode int) error {
+	if step.ExpectStatus != 0 && statusCode != step.ExpectStatus {
+		return fmt.Errorf("expected status %d, got %d", step.ExpectStatus, statusCode)
+	}
+	if step.ExpectStatus == 0 && statusCode >= 400 {
+		return fmt.Errorf("unexpected status %d", statusCode)
+	}
+	return nil
+}
+
+// Extract a variable from a step response
+func (rule *extractRule) extract(page *pageResult) (string, error) {
+	switch {
+	case rule.Regex != "":
+		m := regexp.MustCompile(rule.Regex).FindSubmatch(page.body)
+		if m == nil {
+			return "", fmt.Errorf("regex %s not found", rule.Regex)
+		}
+		if len(m) > 1 {
+			return string(m[1]), nil
+		}
+		return string(m[0]), nil
+
+	case rule.Css != "":
+		doc, err := html.Parse(bytes.NewReader(page.body))
+		if err != nil {
+			return "", err
+		}
+		node := cascadia.MustCompile(rule.Css).MatchFirst(doc)
+		if node == nil {
+			return "", fmt.Errorf("selector %s not found", rule.Css)
+		}
+		if rule.Attr == "" {
+			return nodeText(node), nil
+		}
+		for _, a := range node.Attr {
+			if a.Key == rule.Attr {
+				return a.Val, nil
+			}
+		}
+		return "", fmt.Errorf("selector %s has no %s attribute", rule.Css, rule.Attr)
+
+	case rule.Json != "":
+		return jsonPath(page.body, rule.Json)
+
+	case rule.Header != "":
+		if v := page.mainUrlStat.responseHeader.Get(rule.Header); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("header %s not found", rule.Header)
+	}
+
+	return "", fmt.Errorf("no regex, css, json or header source")
+}
+
+// Text content of a html node
+func nodeText(node *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+	return strings.TrimSpace(b.String())
+}
+
+// Get a value of a json document by its dotted path, like data.items.0.id
+func jsonPath(body []byte, path string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return "", err
+	}
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch v := value.(type) {
+			case map[string]interface{}:
+				item, ok := v[key]
+				if !ok {
+					return "", fmt.Errorf("json path %s not found", path)
+				}
+				value = item
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(v) {
+					return "", fmt.Errorf("json path %s not found", path)
+				}
+				value = v[i]
+			default:
+				return "", fmt.Errorf("json path %s not found", path)
+			}
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// Run the scenario steps in order with a shared cookie jar, stop at the first failure
+func runScenario(scenario *scenarioConfig, target *targetConfig, influx *influxConfig,
+	stream func(step string, statType string, stat *downloadStatistic)) *scenarioResult {
+
+	result := &scenarioResult{name: scenario.Name, total: len(scenario.Steps)}
+
+	fail := func(err error, status int) *scenarioResult {
+		result.err = err
+		result.status = status
+		return result
+	}
+
+	//the SNI override applies to the host of the first step
+	sniUrl := target.Url
+	if len(scenario.Steps) > 0 {
+		sniUrl, _ = expandVariables(scenario.Steps[0].Url, scenario.Variables)
+	}
+	client, transport, err := newHttpClient(target.clientConfig(sniUrl, target.clientTimeout()))
+	if err != nil {
+		return fail(err, NAGIOS_UNKNOWN)
+	}
+	defer transport.CloseIdleConnections()
+	client.Jar, err = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return fail(err, NAGIOS_UNKNOWN)
+	}
+
+	variables := make(map[string]string)
+	for k, v := range scenario.Variables {
+		variables[k] = v
+	}
+
+	var allStats, allFailed []downloadStatistic
+	var gstat globalStatistic
+	previousUrl := ""
+
+	// one har archive for the whole transaction, written when a step fails too
+	if target.Har != "" {
+		defer func() {
+			if err := writeHar(target.Har, allStats, allFailed, gstat); err != nil {
+				fmt.Fprintln(logOutput(), red("Error:"), "har", err)
+			}
+		}()
+	}
+
+	for i := range scenario.Steps {
+		step := &scenario.Steps[i]
+
+		config, err := step.pageConfig(target, previousUrl, variables)
+		if err != nil {
+			return fail(fmt.Errorf("step %s: %v", step.Name, err), NAGIOS_UNKNOWN)
+		}
+
+		//the step as a target for the reports and the sinks
+		stepTarget := *target
+		stepTarget.Name = step.Name
+		stepTarget.Url = config.url
+		stepTarget.Keyword = config.keyword
+		stepTarget.Headers = config.headers
+		stepTarget.UserAgent = ""
+		stepTarget.Har = ""
+
+		var stepStream func(statType string, stat *downloadStatistic)
+		if stream != nil {
+			stepStream = func(statType string, stat *downloadStatistic) {
+				stream(step.Name, statType, stat)
+			}
+		}
+
+		sr := stepResult{target: &stepTarget, page: fetchPage(config, client, stepStream)}
+		sr.err = sr.page.err
+		if sr.err == nil {
+			sr.err = step.checkStatus(sr.page.mainUrlStat.statusCode)
+		}
+		if sr.err == nil && assertionsStatus(sr.page.failures) == NAGIOS_ERROR {
+			sr.err = fmt.Errorf("assertions failed: %s", formatAssertFailures(sr.page.failures))
+		}
+		for name, rule := range step.Extract {
+			if sr.err != nil {
+				break
+			}
+			value, err := rule.extract(&sr.page)
+			if err != nil {
+				sr.err = fmt.Errorf("extract %s: %v", name, err)
+			}
+			variables[name] = value
+		}
+
+		result.steps = append(result.steps, sr)
+		result.duration += sr.page.gstat.totalResponseTime
+		result.size += sr.page.gstat.totalResponseSize
+		allStats = append(allStats, sr.page.assetsStats...)
+		allFailed = append(allFailed, sr.page.failedStats...)
+		gstat.totalResponseTime += sr.page.gstat.totalResponseTime
+		gstat.totalResponseSize += sr.page.gstat.totalResponseSize
+
+		writeSinks(&stepTarget, influx, &sr.page, map[string]string{"scenario": scenario.Name, "step": step.Name})
+		if sr.err != nil {
+			return fail(fmt.Errorf("step %s: %v", step.Name, sr.err), NAGIOS_ERROR)
+		}
+		previousUrl = config.url
+	}
+
+	result.status = nagiosStatus(result.duration, target.NagiosWarning, target.NagiosCritical)
+	for _, sr := range result.steps {
+		result.status = worseNagiosStatus(result.status, assertionsStatus(sr.page.failures))
+	}
+	return result
+}
+
+// Json report of a scenario
+type scenarioReport struct {
+	Type          string               `json:"type,omitempty"`
+	SchemaVersion int                  `json:"schemaVersion"`
+	ElmoVersion   string               `json:"elmoVersion"`
+	Scenario      string               `json:"scenario"`
+	Status        string               `json:"status"`
+	Error         string               `json:"error,omitempty"`
+	Steps         []scenarioStepReport `json:"steps,omitempty"`
+	Totals        scenarioTotals       `json:"totals"`
+}
+
+type scenarioStepReport struct {
+	Error string `json:"stepError,omitempty"`
+	*report
+}
+
+type scenarioTotals struct {
+	Steps        int     `json:"steps"`
+	Passed       int     `json:"passed"`
+	ResponseTime float64 `json:"responseTimeMs"`
+	ResponseSize int     `json:"responseSize"`
+}
+
+// Build the json report of a scenario
+func newScenarioReport(result *scenarioResult) *scenarioReport {
+	r := &scenarioReport{
+		SchemaVersion: reportSchemaVersion,
+		ElmoVersion:   VERSION,
+		Scenario:      result.name,
+		Status:        nagiosStatusName(result.status),
+		Totals: scenarioTotals{
+			Steps:        result.total,
+			ResponseTime: msec(result.duration),
+			ResponseSize: result.size,
+		},
+	}
+	if result.err != nil {
+		r.Error = result.err.Error()
+	}
+	for i := range result.steps {
+		sr := &result.steps[i]
+		step := scenarioStepReport{report: newReport(sr.target, &sr.page, nil)}
+		if sr.err != nil {
+			step.Error = sr.err.Error()
+		} else {
+			r.Totals.Passed++
+		}
+		r.Steps = append(r.Steps, step)
+	}
+	return r
+}
+
+// Write the scenario report, in ndjson mode one summary line
+// is written per step then the scenario line
+func writeScenarioReport(w io.Writer, result *scenarioResult) error {
+	r := newScenarioReport(result)
+
+	if outputFormat == outputNdjson {
+		for _, step := range r.Steps {
+			if err := writeReport(w, step.report); err != nil {
+				return err
+			}
+		}
+		r.Type = "scenario"
+		r.Steps = nil
+		return json.NewEncoder(w).Encode(r)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Print the text summary of a scenario
+func printScenarioSummary(result *scenarioResult) {
+	for i := range result.steps {
+		sr := &result.steps[i]
+		fmt.Printf("%s %d/%d %s: %s\n", bold_white("Step"), i+1, result.total, bold_white(sr.target.Name), sr.target.Url)
+		if sr.page.err == nil {
+			printPageSummary(&sr.page)
+		}
+		if sr.err != nil {
+			fmt.Println(red("Error:"), sr.err)
+		}
+		fmt.Println()
+	}
+
+	if result.err != nil {
+		fmt.Printf("Scenario %s: %s %v.\n", result.name, red("failed,"), result.err)
+		return
+	}
+	fmt.Printf("Scenario %s: %d/%d steps %s in %v, %v%s.\n", result.name, len(result.steps), result.total,
+		green("OK"), cyan(result.duration), white(result.size/1024), white("kb"))
+}
+
+// Print the nagios line of a scenario with the time of each step
+func printScenarioNagios(result *scenarioResult, target *targetConfig) {
+	perfdata := []string{fmt.Sprintf("time=%.3fms;%d;%d;0 size=%dKB",
+		msec(result.duration), target.NagiosWarning, target.NagiosCritical, result.size/1024)}
+	for _, sr := range result.steps {
+		perfdata = append(perfdata, fmt.Sprintf("'%s time'=%.3fms", sr.target.Name, msec(sr.page.gstat.totalResponseTime)))
+	}
+
+	if result.err != nil {
+		fmt.Printf("Scenario %s %s: %v.|%s\n", result.name, nagiosStatusName(result.status), result.err,
+			strings.Join(perfdata, " "))
+		return
+	}
+	fmt.Printf("Scenario %s %s: %d/%d steps in %v.|%s\n", result.name, nagiosStatusName(result.status),
+		len(result.steps), result.total, result.duration, strings.Join(perfdata, " "))
+}
+
+// Run the --scenario file and print its report
+func checkScenario(c *cli.Context) {
+	scenario, err := loadScenario(c.String("scenario"))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(NAGIOS_UNKNOWN)
+	}
+
+	target := flagsTargetConfig(c)
+	influx, err := flagsInfluxConfig(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(NAGIOS_UNKNOWN)
+	}
+
+	//stream the statistics in ndjson mode
+	var stream func(step string, statType string, stat *downloadStatistic)
+	if outputFormat == outputNdjson && !useNagios {
+		stream = func(step string, statType string, stat *downloadStatistic) {
+			writeNdjsonStat(os.Stdout, step, statType, stat)
+		}
+	}
+
+	result := runScenario(scenario, &target, influx, stream)
+
+	if useNagios {
+		printScenarioNagios(result, &target)
+		os.Exit(result.status)
+	} else if !textOutput() {
+		writeScenarioReport(os.Stdout, result)
+	} else {
+		printScenarioSummary(result)
+	}
+
+	if result.err != nil {
+		os.Exit(1)
+	}
+}
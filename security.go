@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Assertion kinds of --audit-security
+const (
+	assertSecurityHeader = "security_header"
+	assertMixedContent   = "mixed_content"
+)
+
+// Status of a security header
+const (
+	headerOk      = "ok"
+	headerMissing = "missing"
+	headerWeak    = "weak"
+)
+
+// HSTS under this max-age in seconds, 180 days, is weak
+const minHstsMaxAge = 180 * 24 * 3600
+
+// Evaluation of a security header of the main response
+type securityHeader struct {
+	name    string
+	value   string
+	status  string
+	message string // why the header is weak or missing
+}
+
+// An http resource of an https document
+type mixedContent struct {
+	url      string
+	document string
+	reason   string
+	active   bool // blocked by browsers, passive content is only upgraded or warned about
+}
+
+// Upgradeable mixed content, the other resources can change the page and are blocked
+var passiveReasons = map[string]bool{"img": true, "video": true, "audio": true, "source": true}
+
+// Evaluate the security headers of the main response
+func auditSecurityHeaders(stat *downloadStatistic) []securityHeader {
+	header := stat.responseHeader
+	if header == nil {
+		header = http.Header{}
+	}
+	csp := cspDirectives(header.Get("Content-Security-Policy"))
+	get := func(name string) securityHeader {
+		h := securityHeader{name: name, value: header.Get(name), status: headerOk}
+		if h.value == "" {
+			h.status = headerMissing
+		}
+		return h
+	}
+
+	hsts := get("Strict-Transport-Security")
+	if documentScheme(stat) != "https" {
+		hsts.status, hsts.message = headerMissing, "page served over http"
+	} else if hsts.status == headerOk {
+		maxAge, err := strconv.Atoi(cacheControl(http.Header{"Cache-Control": {hsts.value}})["max-age"])
+		if err != nil || maxAge < minHstsMaxAge {
+			hsts.status, hsts.message = headerWeak, "max-age under 180 days"
+		}
+	}
+
+	cspHeader := get("Content-Security-Policy")
+	if cspHeader.status == headerMissing && header.Get("Content-Security-Policy-Report-Only") != "" {
+		cspHeader.value = header.Get("Content-Security-Policy-Report-Only")
+		cspHeader.status, cspHeader.message = headerWeak, "report only"
+	} else if cspHeader.status == headerOk {
+		scripts, ok := csp["script-src"]
+		if !ok {
+			scripts = csp["default-src"]
+		}
+		if strings.Contains(scripts, "'unsafe-inline'") || strings.Contains(scripts, "'unsafe-eval'") {
+			cspHeader.status, cspHeader.message = headerWeak, "scripts allow 'unsafe-inline' or 'unsafe-eval'"
+		}
+	}
+
+	frameOptions := get("X-Frame-Options")
+	switch strings.ToUpper(strings.TrimSpace(frameOptions.value)) {
+	case "DENY", "SAMEORIGIN":
+	case "":
+		if _, ok := csp["frame-ancestors"]; ok {
+			frameOptions.status, frameOptions.message = headerOk, "replaced by the csp frame-ancestors"
+		}
+	default:
+		frameOptions.status, frameOptions.message = headerWeak, "not DENY or SAMEORIGIN"
+	}
+
+	contentTypeOptions := get("X-Content-Type-Options")
+	if contentTypeOptions.status == headerOk && !strings.EqualFold(strings.TrimSpace(contentTypeOptions.value), "nosniff") {
+		contentTypeOptions.status, contentTypeOptions.message = headerWeak, "not nosniff"
+	}
+
+	referrer := get("Referrer-Policy")
+	if referrer.status == headerOk {
+		//with a list of policies the last one is used
+		policies := strings.Split(referrer.value, ",")
+		switch strings.ToLower(strings.TrimSpace(policies[len(policies)-1])) {
+		case "unsafe-url", "no-referrer-when-downgrade":
+			referrer.status, referrer.message = headerWeak, "leaks the full url to other origins"
+		}
+	}
+
+	return []securityHeader{hsts, cspHeader, frameOptions, contentTypeOptions, referrer, get("Permissions-Policy")}
+}
+
+// Parse the Content-Security-Policy directives, the first one of a name is used
+func cspDirectives(policy string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if _, ok := directives[name]; !ok {
+			directives[name] = strings.ToLower(strings.Join(fields[1:], " "))
+		}
+	}
+	return directives
+}
+
+// Scheme of the document after redirects
+func documentScheme(stat *downloadStatistic) string {
+	documentUrl := stat.finalUrl
+	if documentUrl == "" {
+		documentUrl = stat.url
+	}
+	if u, err := url.Parse(documentUrl); err == nil {
+		return strings.ToLower(u.Scheme)
+	}
+	return ""
+}
+
+// The http resources of the https documents of a page, the page itself or its frames.
+// All the assets found are checked, also the ones outside the allowed domains.
+func auditMixedContent(page *pageResult) []mixedContent {
+	documents := map[string]string{"": documentScheme(&page.mainUrlStat)}
+	for i := range page.assetsStats {
+		if stat := &page.assetsStats[i]; stat.frameDepth > 0 {
+			documents[stat.url] = documentScheme(stat)
+		}
+	}
+
+	var mixed []mixedContent
+	seen := make(map[string]bool)
+	for _, assetUrl := range page.assets {
+		if seen[assetUrl] {
+			continue
+		}
+		seen[assetUrl] = true
+
+		origin := page.origins[assetUrl]
+		u, err := url.Parse(assetUrl)
+		if err != nil || !strings.EqualFold(u.Scheme, "http") || documents[origin.frame] != "https" {
+			continue
+		}
+		document := origin.frame
+		if document == "" {
+			document = page.mainUrlStat.url
+		}
+		mixed = append(mixed, mixedContent{url: assetUrl, document: document, reason: origin.reason, active: !passiveReasons[origin.reason]})
+	}
+	return mixed
+}
+
+// Flag the missing or weak security headers as a warning, active mixed content
+// as critical and passive mixed content as a warning
+func checkSecurity(page *pageResult) []assertFailure {
+	var failures []assertFailure
+	var issues []string
+	for _, h := range auditSecurityHeaders(&page.mainUrlStat) {
+		if h.status != headerOk {
+			issue := h.name + " " + h.status
+			if h.message != "" {
+				issue += " (" + h.message + ")"
+			}
+			issues = append(issues, issue)
+		}
+	}
+	if len(issues) > 0 {
+		failures = append(failures, assertFailure{
+			kind:    assertSecurityHeader,
+			message: "security headers: " + strings.Join(issues, ", "),
+			status:  NAGIOS_WARNING,
+		})
+	}
+
+	var active, passive int
+	for _, m := range auditMixedContent(page) {
+		if m.active {
+			active++
+		} else {
+			passive++
+		}
+	}
+	if active > 0 {
+		failures = append(failures, assertFailure{
+			kind:    assertMixedContent,
+			message: fmt.Sprintf("%d active and %d passive mixed content resources", active, passive),
+			status:  NAGIOS_ERROR,
+		})
+	} else if passive > 0 {
+		failures = append(failures, assertFailure{
+			kind:    assertMixedContent,
+			message: fmt.Sprintf("%d passive mixed content resources", passive),
+			status:  NAGIOS_WARNING,
+		})
+	}
+	return failures
+}
+
+// Print the security headers of the main response and the mixed content
+func printSecurityAudit(page *pageResult) {
+	fmt.Println("Security headers:")
+	for _, h := range auditSecurityHeaders(&page.mainUrlStat) {
+		switch h.status {
+		case headerOk:
+			if h.value == "" {
+				fmt.Printf("\t%s %s, %s\n", green(h.status), h.name, h.message)
+			} else {
+				fmt.Printf("\t%s %s: %s\n", green(h.status), h.name, h.value)
+			}
+		case headerWeak:
+			fmt.Printf("\t%s %s: %s, %s\n", red(h.status), h.name, h.value, h.message)
+		case headerMissing:
+			if h.message == "" {
+				fmt.Printf("\t%s %s\n", red(h.status), h.name)
+			} else {
+				fmt.Printf("\t%s %s, %s\n", red(h.status), h.name, h.message)
+			}
+		}
+	}
+
+	mixed := auditMixedContent(page)
+	if len(mixed) == 0 {
+		return
+	}
+	fmt.Printf("Mixed content: %d http resources on https documents.\n", len(mixed))
+	for _, m := range mixed {
+		kind := "passive"
+		if m.active {
+			kind = "active"
+		}
+		fmt.Printf("\t%s %s from %s in %s\n", kind, m.url, m.reason, m.document)
+	}
+}
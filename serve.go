@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/urfave/cli/v2"
+)
+
+// Probe module, like the blackbox_exporter ones.
+// Unset values fall back to the global flags.
+type moduleConfig struct {
+	Headers               map[string]string `yaml:"headers" toml:"headers"`
+	UserAgent             string            `yaml:"user_agent" toml:"user_agent"`
+	Keyword               string            `yaml:"keyword" toml:"keyword"`
+	AssetsAllowedDomains  string            `yaml:"assets_allowed_domains" toml:"assets_allowed_domains"`
+	Parallel              int               `yaml:"parallel" toml:"parallel"`
+	NoDedup               bool              `yaml:"no_dedup" toml:"no_dedup"`
+	Timeout               int               `yaml:"timeout" toml:"timeout"`
+	ConnectTimeout        int               `yaml:"connect_timeout" toml:"connect_timeout"`
+	TlsTimeout            int               `yaml:"tls_timeout" toml:"tls_timeout"`
+	ResponseHeaderTimeout int               `yaml:"response_header_timeout" toml:"response_header_timeout"`
+	Resolve               stringList        `yaml:"resolve" toml:"resolve"`
+	DnsServer             string            `yaml:"dns_server" toml:"dns_server"`
+	IpVersion             int               `yaml:"ip_version" toml:"ip_version"` // 4 or 6
+	Assert                assertConfig      `yaml:"assert" toml:"assert"`
+	CertWarningDays       int               `yaml:"cert_warning_days" toml:"cert_warning_days"`
+	CertCriticalDays      int               `yaml:"cert_critical_days" toml:"cert_critical_days"`
+	CaFile                string            `yaml:"ca_file" toml:"ca_file"`
+	CertFile              string            `yaml:"cert_file" toml:"cert_file"`
+	KeyFile               string            `yaml:"key_file" toml:"key_file"`
+	Pkcs12File            string            `yaml:"pkcs12_file" toml:"pkcs12_file"`
+	Pkcs12Password        string            `yaml:"pkcs12_password" toml:"pkcs12_password"`
+	Sni                   string            `yaml:"sni" toml:"sni"`
+	TlsMinVersion         string            `yaml:"tls_min_version" toml:"tls_min_version"`
+	TlsMaxVersion         string            `yaml:"tls_max_version" toml:"tls_max_version"`
+	TlsCiphers            string            `yaml:"tls_ciphers" toml:"tls_ciphers"`
+	Insecure              bool              `yaml:"insecure" toml:"insecure"`
+	HttpVersion           string            `yaml:"http_version" toml:"http_version"` // 1.1, 2 or 3
+	Proxy                 string            `yaml:"proxy" toml:"proxy"`
+	NoProxy               string            `yaml:"no_proxy" toml:"no_proxy"`
+	ProxyPac              string            `yaml:"proxy_pac" toml:"proxy_pac"`
+	FrameDepth            int               `yaml:"frame_depth" toml:"frame_depth"`
+	IncludePrefetch       bool              `yaml:"include_prefetch" toml:"include_prefetch"`
+	MaxAssetSize          int               `yaml:"max_asset_size" toml:"max_asset_size"`
+	HashAssets            bool              `yaml:"hash_assets" toml:"hash_assets"`
+	AuditCompression      bool              `yaml:"audit_compression" toml:"audit_compression"`
+	AuditCache            bool              `yaml:"audit_cache" toml:"audit_cache"`
+	MaxUncacheable        int               `yaml:"max_uncacheable" toml:"max_uncacheable"`
+	AuditSecurity         bool              `yaml:"audit_security" toml:"audit_security"`
+	ViewportWidth         int               `yaml:"viewport_width" toml:"viewport_width"`
+	Dpr                   float64           `yaml:"dpr" toml:"dpr"`
+
+	pacScript *pacScript // ProxyPac loaded once by the daemon
+}
+
+// Probe modules of the serve command
+type serveConfig struct {
+	Modules map[string]moduleConfig
+}
+
+var probesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "elmo_probes_total",
+	Help: "Count of probes by module and result.",
+}, []string{"module", "result"})
+
+func init() {
+	prometheus.MustRegister(probesTotal)
+}
+
+func serveCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "serve",
+		Usage: "Run a prometheus exporter, probe pages with /probe?target=<url>&module=<name>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "listen-address",
+				Value: ":9710",
+				Usage: "Address to listen on",
+			},
+		},
+		Action: serve,
+	}
+}
+
+// Load the probe modules from the configuration file,
+// the default module is built from the global flags
+func loadServeConfig(c *cli.Context) (*serveConfig, error) {
+	config := &serveConfig{Modules: make(map[string]moduleConfig)}
+
+	if c.String("config") != "" {
+		file, err := loadFileConfig(c.String("config"))
+		if err != nil {
+			return nil, err
+		}
+		for name, module := range file.Modules {
+			config.Modules[name] = module
+		}
+	}
+
+	defaults := flagsModuleConfig(c)
+	for name, module := range config.Modules {
+		module = module.withDefaults(&defaults)
+		if err := module.Assert.validate(); err != nil {
+			return nil, fmt.Errorf("module %s: %v", name, err)
+		}
+		config.Modules[name] = module
+	}
+	if _, ok := config.Modules["default"]; !ok {
+		config.Modules["default"] = defaults
+	}
+
+	return config, nil
+}
+
+// Build a module from the global flags
+func flagsModuleConfig(c *cli.Context) moduleConfig {
+	module := moduleConfig{
+		Headers:               make(map[string]string),
+		UserAgent:             c.String("user-agent"),
+		Keyword:               c.String("keyword"),
+		AssetsAllowedDomains:  c.String("assets-allowed-domains"),
+		Parallel:              c.Int("parallel"),
+		NoDedup:               c.Bool("no-dedup"),
+		Timeout:               c.Int("timeout"),
+		ConnectTimeout:        c.Int("connect-timeout"),
+		TlsTimeout:            c.Int("tls-timeout"),
+		ResponseHeaderTimeout: c.Int("response-header-timeout"),
+		Resolve:               c.StringSlice("resolve"),
+		DnsServer:             c.String("dns-server"),
+		IpVersion:             flagsIpVersion(c),
+		Assert: parseAssertFlags(c.StringSlice("assert-keyword"), c.StringSlice("assert-not-keyword"),
+			c.StringSlice("assert-regex"), c.StringSlice("assert-not-regex"), c.StringSlice("assert-status"),
+			c.StringSlice("assert-header"), c.StringSlice("assert-forbidden-header"), c.Int("assert-max-body-size"),
+			c.String("assert-content-type"), c.StringSlice("assert-css"), c.StringSlice("assert-xpath"),
+			c.StringSlice("assert-warning")),
+		CertWarningDays:  c.Int("cert-warning-days"),
+		CertCriticalDays: c.Int("cert-critical-days"),
+		CaFile:           c.String("cacert"),
+		CertFile:         c.String("cert"),
+		KeyFile:          c.String("key"),
+		Pkcs12File:       c.String("pkcs12"),
+		Pkcs12Password:   c.String("pkcs12-password"),
+		Sni:              c.String("sni"),
+		TlsMinVersion:    c.String("tls-min-version"),
+		TlsMaxVersion:    c.String("tls-max-version"),
+		TlsCiphers:       c.String("tls-ciphers"),
+		Insecure:         c.Bool("insecure"),
+		HttpVersion:      flagsHttpVersion(c),
+		Proxy:            c.String("proxy"),
+		NoProxy:          c.String("no-proxy"),
+		ProxyPac:         c.String("proxy-pac"),
+		FrameDepth:       c.Int("frame-depth"),
+		IncludePrefetch:  c.Bool("include-prefetch"),
+		MaxAssetSize:     c.Int("max-asset-size"),
+		HashAssets:       c.Bool("hash-assets"),
+		AuditCompression: c.Bool("audit-compression"),
+		AuditCache:       c.Bool("audit-cache"),
+		MaxUncacheable:   c.Int("max-uncacheable"),
+		AuditSecurity:    c.Bool("audit-security"),
+		ViewportWidth:    c.Int("viewport-width"),
+		Dpr:              c.Float64("dpr"),
+	}
+	for _, h := range c.StringSlice("header") {
+		k, v, _ := cutHeader(h)
+		module.Headers[k] = v
+	}
+	return module
+}
+
+// Emulated viewport of a module, the device pixel ratio is 1 if not set
+func (m *moduleConfig) viewport() viewport {
+	v := viewport{width: m.ViewportWidth, dpr: m.Dpr}
+	if v.dpr <= 0 {
+		v.dpr = 1
+	}
+	return v
+}
+
+// HTTP version of the --http1.1, --http2 and --http3 flags, empty to negotiate it
+func flagsHttpVersion(c *cli.Context) string {
+	version := httpVersionAuto
+	for _, v := range []string{httpVersion1, httpVersion2, httpVersion3} {
+		if c.Bool("http" + v) {
+			version = v
+		}
+	}
+	return version
+}
+
+// Address family of the -4 and -6 flags, 0 for both
+func flagsIpVersion(c *cli.Context) int {
+	switch {
+	case c.Bool("ipv4"):
+		return 4
+	case c.Bool("ipv6"):
+		return 6
+	}
+	return 0
+}
+
+// Fill the unset values of a module
+func (m moduleConfig) withDefaults(defaults *moduleConfig) moduleConfig {
+	headers := make(map[string]string)
+	for k, v := range defaults.Headers {
+		headers[k] = v
+	}
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	m.Headers = headers
+
+	if m.UserAgent == "" {
+		m.UserAgent = defaults.UserAgent
+	}
+	if m.Keyword == "" {
+		m.Keyword = defaults.Keyword
+	}
+	if m.AssetsAllowedDomains == "" {
+		m.AssetsAllowedDomains = defaults.AssetsAllowedDomains
+	}
+	if m.Parallel == 0 {
+		m.Parallel = defaults.Parallel
+	}
+	if m.Timeout == 0 {
+		m.Timeout = defaults.Timeout
+	}
+	if m.ConnectTimeout == 0 {
+		m.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if m.TlsTimeout == 0 {
+		m.TlsTimeout = defaults.TlsTimeout
+	}
+	if m.ResponseHeaderTimeout == 0 {
+		m.ResponseHeaderTimeout = defaults.ResponseHeaderTimeout
+	}
+	if len(m.Resolve) == 0 {
+		m.Resolve = defaults.Resolve
+	}
+	if m.DnsServer == "" {
+		m.DnsServer = defaults.DnsServer
+	}
+	if m.IpVersion == 0 {
+		m.IpVersion = defaults.IpVersion
+	}
+	if m.CertWarningDays == 0 {
+		m.CertWarningDays = defaults.CertWarningDays
+	}
+	if m.CertCriticalDays == 0 {
+		m.CertCriticalDays = defaults.CertCriticalDays
+	}
+	if m.CaFile == "" {
+		m.CaFile = defaults.CaFile
+	}
+	//the client certificate is taken as a whole
+	if m.CertFile == "" && m.Pkcs12File == "" {
+		m.CertFile, m.KeyFile = defaults.CertFile, defaults.KeyFile
+		m.Pkcs12File, m.Pkcs12Password = defaults.Pkcs12File, defaults.Pkcs12Password
+	}
+	if m.Sni == "" {
+		m.Sni = defaults.Sni
+	}
+	if m.TlsMinVersion == "" {
+		m.TlsMinVersion = defaults.TlsMinVersion
+	}
+	if m.TlsMaxVersion == "" {
+		m.TlsMaxVersion = defaults.TlsMaxVersion
+	}
+	if m.TlsCiphers == "" {
+		m.TlsCiphers = defaults.TlsCiphers
+	}
+	m.Insecure = m.Insecure || defaults.Insecure
+	if m.HttpVersion == "" {
+		m.HttpVersion = defaults.HttpVersion
+	}
+	//the proxy selection is taken as a whole
+	if m.Proxy == "" && m.NoProxy == "" && m.ProxyPac == "" {
+		m.Proxy, m.NoProxy, m.ProxyPac = defaults.Proxy, defaults.NoProxy, defaults.ProxyPac
+	}
+	if m.FrameDepth == 0 {
+		m.FrameDepth = defaults.FrameDepth
+	}
+	m.IncludePrefetch = m.IncludePrefetch || defaults.IncludePrefetch
+	if m.MaxAssetSize == 0 {
+		m.MaxAssetSize = defaults.MaxAssetSize
+	}
+	m.HashAssets = m.HashAssets || defaults.HashAssets
+	m.AuditCompression = m.AuditCompression || defaults.AuditCompression
+	m.AuditCache = m.AuditCache || defaults.AuditCache
+	m.AuditSecurity = m.AuditSecurity || defaults.AuditSecurity
+	if m.MaxUncacheable == 0 {
+		m.MaxUncacheable = defaults.MaxUncacheable
+	}
+	m.Assert = m.Assert.withDefaults(&defaults.Assert)
+	m.NoDedup = m.NoDedup || defaults.NoDedup
+	if m.ViewportWidth == 0 {
+		m.ViewportWidth = defaults.ViewportWidth
+	}
+	if m.Dpr == 0 {
+		m.Dpr = defaults.Dpr
+	}
+	return m
+}
+
+// Run the exporter
+func serve(c *cli.Context) error {
+	config, err := loadServeConfig(c)
+	if err != nil {
+		fmt.Println(red("Fatal:"), err)
+		os.Exit(1)
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		probeHandler(w, r, config)
+	})
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><head><title>Elmo exporter</title></head><body>"+
+			"<h1>Elmo exporter</h1><p><a href=\"/probe?target=https://example.com\">Probe example.com</a></p>"+
+			"<p><a href=\"/metrics\">Metrics</a></p></body></html>")
+	})
+
+	fmt.Printf("Listening on %s\n", c.String("listen-address"))
+	if err := http.ListenAndServe(c.String("listen-address"), nil); err != nil {
+		fmt.Println(red("Fatal:"), err)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Probe a target and write its metrics
+func probeHandler(w http.ResponseWriter, r *http.Request, config *serveConfig) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	moduleName := r.URL.Query().Get("module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+	module, ok := config.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	// do not run longer than the prometheus scrape timeout
+	timeoutMs := module.Timeout
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil {
+			if scrapeTimeout := int(seconds * 1000); timeoutMs == 0 || scrapeTimeout < timeoutMs {
+				timeoutMs = scrapeTimeout
+			}
+		}
+	}
+
+	client, transport, err := newHttpClient(module.clientConfig(target, timeoutMs))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	//each probe has its own client, its connections are not reused
+	defer transport.CloseIdleConnections()
+
+	//the page is fetched with the settings of a target, like with the cli
+	probe := targetConfig{Url: target, moduleConfig: module}
+
+	start := time.Now()
+	page := fetchPage(probe.pageConfig(), client, nil)
+
+	registry := prometheus.NewRegistry()
+	registerProbeMetrics(registry, &page, module.Keyword != "", time.Since(start))
+
+	result := "success"
+	if page.err != nil {
+		result = "failure"
+	}
+	probesTotal.WithLabelValues(moduleName, result).Inc()
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// Register the metrics of a page fetch
+func registerProbeMetrics(registry *prometheus.Registry, page *pageResult, checkKeyword bool, duration time.Duration) {
+	gauge := func(name string, help string, value float64) {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+		g.Set(value)
+		registry.MustRegister(g)
+	}
+
+	success := 0.0
+	if page.err == nil && assertionsStatus(page.failures) != NAGIOS_ERROR {
+		success = 1
+	}
+	gauge("probe_success", "Displays whether or not the probe was a success", success)
+	gauge("probe_duration_seconds", "Returns how long the probe took to complete in seconds", duration.Seconds())
+	gauge("probe_http_status_code", "Response HTTP status code of the main url", float64(page.mainUrlStat.statusCode))
+	if major, minor, ok := http.ParseHTTPVersion(page.mainUrlStat.proto); ok {
+		gauge("probe_http_version", "Returns the version of HTTP of the main url response", float64(major)+float64(minor)/10)
+	}
+	gauge("elmo_page_duration_seconds", "Time to fetch the page and all its assets", page.gstat.totalResponseTime.Seconds())
+	gauge("elmo_page_size_bytes", "Total bytes of the page and all its assets", float64(page.gstat.totalResponseSize))
+	gauge("elmo_page_transfer_bytes", "Total bytes on the wire of the page and all its assets, before decoding", float64(page.gstat.totalEncodedSize))
+	if page.auditCompression {
+		_, savings := auditCompression(page)
+		gauge("elmo_compression_savings_bytes", "Bytes gzip would save on the text responses served without compression", float64(savings))
+	}
+	if page.auditCache {
+		_, uncacheable, _ := auditCache(page)
+		gauge("elmo_uncacheable_bytes", "Bytes on the wire of the responses downloaded again on the next visit", float64(uncacheable))
+	}
+	if page.auditSecurity {
+		var missing, active, passive float64
+		for _, h := range auditSecurityHeaders(&page.mainUrlStat) {
+			if h.status != headerOk {
+				missing++
+			}
+		}
+		for _, m := range auditMixedContent(page) {
+			if m.active {
+				active++
+			} else {
+				passive++
+			}
+		}
+		gauge("elmo_security_headers_missing", "Security headers of the main url missing or weak", missing)
+		mixed := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "elmo_mixed_content_resources", Help: "Http resources of https documents"}, []string{"kind"})
+		mixed.WithLabelValues("active").Set(active)
+		mixed.WithLabelValues("passive").Set(passive)
+		registry.MustRegister(mixed)
+	}
+
+	if checkKeyword {
+		match := 1.0
+		//no match either when the page could not be fetched
+		if page.err != nil {
+			match = 0
+		}
+		gauge("elmo_keyword_match", "Whether the keyword was found in the main url", match)
+	}
+
+	// assertions failures
+	failures := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "elmo_assertion_failures",
+		Help: "Count of failed assertions on the main url by kind",
+	}, []string{"kind"})
+	for _, f := range page.failures {
+		failures.WithLabelValues(f.kind).Inc()
+	}
+	registry.MustRegister(failures)
+
+	// certificates expiry, like the blackbox_exporter
+	certs := pageCertificates(page)
+	if u, err := url.Parse(page.mainUrlStat.url); err == nil && certs[u.Host] != nil {
+		gauge("probe_ssl_earliest_cert_expiry", "Returns earliest SSL cert expiry date of the main url",
+			float64(certs[u.Host].earliestExpiry().Unix()))
+	}
+	certExpiry := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "elmo_ssl_earliest_cert_expiry",
+		Help: "Earliest SSL cert expiry date by host of the page",
+	}, []string{"host"})
+	for host, info := range certs {
+		certExpiry.WithLabelValues(host).Set(float64(info.earliestExpiry().Unix()))
+	}
+	registry.MustRegister(certExpiry)
+
+	// main url phases
+	mainPhases := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "elmo_main_phase_duration_seconds",
+		Help: "Duration of the main url request phases",
+	}, []string{"phase"})
+	for phase, d := range statPhases(&page.mainUrlStat) {
+		mainPhases.WithLabelValues(phase).Set(d.Seconds())
+	}
+	registry.MustRegister(mainPhases)
+
+	// all requests phases
+	phases := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "elmo_request_phase_duration_seconds",
+		Help:    "Duration of the request phases of the main url and its assets",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"phase"})
+	responses := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "elmo_responses",
+		Help: "Count of responses by status code",
+	}, []string{"code"})
+	for i := range page.assetsStats {
+		stat := &page.assetsStats[i]
+		for phase, d := range statPhases(stat) {
+			phases.WithLabelValues(phase).Observe(d.Seconds())
+		}
+		responses.WithLabelValues(strconv.Itoa(stat.statusCode)).Inc()
+	}
+	registry.MustRegister(phases, responses)
+
+	assets := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "elmo_assets",
+		Help: "Count of assets by state",
+	}, []string{"state"})
+	downloaded := len(page.assetsStats) - 1
+	if downloaded < 0 {
+		downloaded = 0
+	}
+	assets.WithLabelValues("discovered").Set(float64(len(page.assets)))
+	assets.WithLabelValues("downloaded").Set(float64(downloaded))
+	assets.WithLabelValues("failed").Set(float64(len(page.failedStats)))
+	assets.WithLabelValues("duplicate").Set(float64(countDuplicates(page.duplicates)))
+	assets.WithLabelValues("loop").Set(float64(countDuplicates(page.loops)))
+	registry.MustRegister(assets)
+
+	usage := pageConnectionUsage(page.assetsStats)
+	gauge("elmo_connections", "Count of connections used by the page", float64(usage.connections))
+	gauge("elmo_max_concurrent_requests_per_connection", "Most requests in flight on one connection",
+		float64(usage.maxConcurrent))
+}
+
+// Request phases of a statistic by name
+func statPhases(stat *downloadStatistic) map[string]time.Duration {
+	return map[string]time.Duration{
+		"dns":      stat.dnsTime,
+		"connect":  stat.connectTime,
+		"proxy":    stat.proxyTime,
+		"tls":      stat.tlsTime,
+		"ttfb":     stat.ttfb,
+		"download": stat.downloadTime,
+	}
+}
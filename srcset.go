@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// A srcset image candidate, see
+// https://html.spec.whatwg.org/multipage/images.html#srcset-attributes
+type srcsetCandidate struct {
+	url     string
+	width   int     // w descriptor, 0 if not set
+	density float64 // x descriptor, 0 if not set
+}
+
+// Emulated viewport to select the images, a width of 0 selects all the candidates
+type viewport struct {
+	width int
+	dpr   float64
+}
+
+type viewportKey struct{}
+
+// Select the images of the documents of a request for this viewport
+func withViewport(req *http.Request, v viewport) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), viewportKey{}, v))
+}
+
+// Viewport of a request, all the candidates if not set
+func requestViewport(req *http.Request) viewport {
+	if v, ok := req.Context().Value(viewportKey{}).(viewport); ok {
+		return v
+	}
+	return viewport{dpr: 1}
+}
+
+// Media elements state while walking the document
+type mediaState struct {
+	viewport            viewport
+	inPicture           bool
+	pictureSourceChosen bool
+	inMedia             bool
+	mediaSourceChosen   bool
+}
+
+// Parse a srcset attribute into its candidates
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+
+	s := srcset
+	for {
+		// skip leading whitespaces and commas
+		s = strings.TrimLeft(s, " \t\n\r\f,")
+		if s == "" {
+			return candidates
+		}
+
+		// collect the url
+		end := strings.IndexAny(s, " \t\n\r\f")
+		if end == -1 {
+			end = len(s)
+		}
+		candidate := srcsetCandidate{url: s[:end]}
+		s = s[end:]
+
+		// a trailing comma ends the candidate without descriptors
+		if strings.HasSuffix(candidate.url, ",") {
+			candidate.url = strings.TrimRight(candidate.url, ",")
+			candidates = append(candidates, candidate)
+			continue
+		}
+
+		// collect descriptors until the next comma outside parens
+		depth := 0
+		end = len(s)
+		for i, c := range s {
+			if c == '(' {
+				depth++
+			} else if c == ')' && depth > 0 {
+				depth--
+			} else if c == ',' && depth == 0 {
+				end = i
+				break
+			}
+		}
+		for _, d := range strings.Fields(s[:end]) {
+			if len(d) < 2 {
+				continue
+			}
+			value := d[:len(d)-1]
+			switch d[len(d)-1] {
+			case 'w':
+				candidate.width, _ = strconv.Atoi(value)
+			case 'x':
+				candidate.density, _ = strconv.ParseFloat(value, 64)
+			}
+		}
+		s = s[end:]
+
+		candidates = append(candidates, candidate)
+	}
+}
+
+var mediaWidthRegexp = regexp.MustCompile(`\(\s*(min|max)-width\s*:\s*([0-9.]+)px\s*\)`)
+
+// Evaluate a media query against the emulated viewport,
+// only min-width and max-width conditions are understood
+func mediaMatches(media string, v viewport) bool {
+	for _, m := range mediaWidthRegexp.FindAllStringSubmatch(media, -1) {
+		width, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		if m[1] == "min" && float64(v.width) < width {
+			return false
+		}
+		if m[1] == "max" && float64(v.width) > width {
+			return false
+		}
+	}
+	return true
+}
+
+// Compute the rendered image width in px from a sizes attribute
+func sourceSize(sizes string, v viewport) float64 {
+	for _, size := range strings.Split(sizes, ",") {
+		size = strings.TrimSpace(size)
+		if size == "" {
+			continue
+		}
+
+		// the length is the last part of the entry, preceded by an optional media condition
+		media := ""
+		length := size
+		if i := strings.LastIndexAny(size, " )"); i != -1 {
+			media, length = size[:i+1], strings.TrimSpace(size[i+1:])
+		}
+		if !mediaMatches(media, v) {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(length, "vw"):
+			if w, err := strconv.ParseFloat(strings.TrimSuffix(length, "vw"), 64); err == nil {
+				return w * float64(v.width) / 100
+			}
+		case strings.HasSuffix(length, "px"):
+			if w, err := strconv.ParseFloat(strings.TrimSuffix(length, "px"), 64); err == nil {
+				return w
+			}
+		}
+	}
+
+	// default is the full viewport width
+	return float64(v.width)
+}
+
+// Pick the candidate a browser with the emulated viewport would download
+func selectSrcsetCandidate(candidates []srcsetCandidate, sizes string, v viewport) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	size := sourceSize(sizes, v)
+	density := func(c srcsetCandidate) float64 {
+		if c.width > 0 && size > 0 {
+			return float64(c.width) / size
+		}
+		if c.density > 0 {
+			return c.density
+		}
+		return 1
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return density(candidates[i]) < density(candidates[j])
+	})
+
+	// the smallest candidate covering the device pixel ratio, or the biggest one
+	for _, c := range candidates {
+		if density(c) >= v.dpr {
+			return c.url
+		}
+	}
+	return candidates[len(candidates)-1].url
+}
+
+// Extract the links of media elements: img, picture sources, video, audio and track
+func getMediaLinks(t *html.Token, state *mediaState) (links []string) {
+	var src, srcset, sizes, media, poster string
+	isDefault := false
+	for _, a := range t.Attr {
+		switch a.Key {
+		case "src":
+			src = a.Val
+		case "srcset":
+			srcset = a.Val
+		case "sizes":
+			sizes = a.Val
+		case "media":
+			media = a.Val
+		case "poster":
+			poster = a.Val
+		case "default":
+			isDefault = true
+		}
+	}
+
+	allCandidates := state.viewport.width == 0
+
+	switch t.Data {
+	case "video", "audio":
+		if poster != "" {
+			links = append(links, poster)
+		}
+		if src != "" {
+			links = append(links, src)
+			state.mediaSourceChosen = true
+		}
+
+	case "track":
+		if src != "" && (allCandidates || isDefault) {
+			links = append(links, src)
+		}
+
+	case "source":
+		// picture sources use srcset, audio and video sources use src
+		if state.inPicture && srcset != "" {
+			if allCandidates {
+				for _, c := range parseSrcset(srcset) {
+					links = append(links, c.url)
+				}
+			} else if !state.pictureSourceChosen && mediaMatches(media, state.viewport) {
+				links = append(links, selectSrcsetCandidate(parseSrcset(srcset), sizes, state.viewport))
+				state.pictureSourceChosen = true
+			}
+		} else if state.inMedia && src != "" {
+			if allCandidates || !state.mediaSourceChosen {
+				links = append(links, src)
+				state.mediaSourceChosen = true
+			}
+		}
+
+	case "img":
+		candidates := parseSrcset(srcset)
+		if allCandidates {
+			if src != "" {
+				links = append(links, src)
+			}
+			for _, c := range candidates {
+				if c.url != src {
+					links = append(links, c.url)
+				}
+			}
+			return
+		}
+
+		// a picture source was already selected
+		if state.inPicture && state.pictureSourceChosen {
+			return
+		}
+
+		// the src attribute is the 1x candidate when there is no w descriptor
+		if src != "" {
+			implicit := true
+			for _, c := range candidates {
+				if c.width > 0 || c.density == 1 || c.density == 0 {
+					implicit = false
+				}
+			}
+			if implicit || len(candidates) == 0 {
+				candidates = append(candidates, srcsetCandidate{url: src, density: 1})
+			}
+		}
+		if link := selectSrcsetCandidate(candidates, sizes, state.viewport); link != "" {
+			links = append(links, link)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Default count of targets checked at the same time
+const defaultMaxConcurrentTargets = 4
+
+// A page to check. Unset values fall back to the defaults
+// of the configuration file, then to the global flags.
+type targetConfig struct {
+	Name         string `yaml:"name" toml:"name"`
+	Url          string `yaml:"url" toml:"url"`
+	moduleConfig `yaml:",inline"`
+
+	NagiosWarning  int               `yaml:"nagios_warning" toml:"nagios_warning"`
+	NagiosCritical int               `yaml:"nagios_critical" toml:"nagios_critical"`
+	RepeatView     bool              `yaml:"repeat_view" toml:"repeat_view"`
+	Har            string            `yaml:"har" toml:"har"`
+	LineProtocol   string            `yaml:"line_protocol" toml:"line_protocol"`
+	UseInflux      bool              `yaml:"use_influx" toml:"use_influx"`
+	InfluxTags     map[string]string `yaml:"influx_tags" toml:"influx_tags"`
+	Interval       string            `yaml:"interval" toml:"interval"` // daemon only
+}
+
+// Configuration file given with --config
+type fileConfig struct {
+	MaxConcurrentTargets int                     `yaml:"max_concurrent_targets" toml:"max_concurrent_targets"`
+	Defaults             targetConfig            `yaml:"defaults" toml:"defaults"`
+	Targets              []targetConfig          `yaml:"targets" toml:"targets"`
+	Modules              map[string]moduleConfig `yaml:"modules" toml:"modules"`
+}
+
+// A list of values, also accepting a single value in the configuration files
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var values []string
+	if err := value.Decode(&values); err != nil {
+		return err
+	}
+	*l = values
+	return nil
+}
+
+func (l *stringList) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*l = stringList{v}
+	case []interface{}:
+		*l = nil
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a string, got %v", item)
+			}
+			*l = append(*l, s)
+		}
+	default:
+		return fmt.Errorf("expected a string or a list of strings, got %v", data)
+	}
+	return nil
+}
+
+// Result of a target check
+type targetResult struct {
+	target     *targetConfig
+	page       pageResult
+	repeatPage *pageResult
+	status     int
+	err        error
+}
+
+// Load a yaml or toml configuration file, toml is chosen by the .toml extension
+func loadFileConfig(path string) (*fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &fileConfig{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, config)
+	} else {
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := config.Defaults.Assert.validate(); err != nil {
+		return nil, fmt.Errorf("%s: defaults: %v", path, err)
+	}
+	hars := make(map[string]int)
+	for i, target := range config.Targets {
+		if target.Url == "" {
+			return nil, fmt.Errorf("%s: target %d has no url", path, i+1)
+		}
+		//the targets are checked concurrently, they would overwrite each other's archive
+		if target.Har != "" {
+			if j, ok := hars[target.Har]; ok {
+				return nil, fmt.Errorf("%s: target %d: har %s is already written by target %d", path, i+1, target.Har, j)
+			}
+			hars[target.Har] = i + 1
+		}
+		if err := target.Assert.validate(); err != nil {
+			return nil, fmt.Errorf("%s: target %d: %v", path, i+1, err)
+		}
+		if target.Name == "" {
+			config.Targets[i].Name = target.Url
+		}
+	}
+	if config.MaxConcurrentTargets <= 0 {
+		config.MaxConcurrentTargets = defaultMaxConcurrentTargets
+	}
+
+	return config, nil
+}
+
+// Build a target from the global flags
+func flagsTargetConfig(c *cli.Context) targetConfig {
+	return targetConfig{
+		Url:            c.String("url"),
+		moduleConfig:   flagsModuleConfig(c),
+		NagiosWarning:  c.Int("nagios-warning"),
+		NagiosCritical: c.Int("nagios-critical"),
+		RepeatView:     c.Bool("repeat-view"),
+		Har:            c.String("har"),
+		LineProtocol:   c.String("line-protocol"),
+		UseInflux:      c.Bool("use-influx"),
+	}
+}
+
+// Build the influxdb sink from the global flags
+func flagsInfluxConfig(c *cli.Context) (*influxConfig, error) {
+	tags, err := parseInfluxTags(c.StringSlice("influx-tag"))
+	if err != nil {
+		return nil, err
+	}
+	return &influxConfig{
+		url:         c.String("influx-url"),
+		version:     c.Int("influx-version"),
+		database:    c.String("influx-database"),
+		username:    c.String("influx-username"),
+		password:    c.String("influx-password"),
+		org:         c.String("influx-org"),
+		bucket:      c.String("influx-bucket"),
+		token:       c.String("influx-token"),
+		measurement: c.String("influx-measurement"),
+		tags:        tags,
+	}, nil
+}
+
+// Fill the unset values of a target, switches are enabled by either side
+func (t targetConfig) withDefaults(defaults *targetConfig) targetConfig {
+	t.moduleConfig = t.moduleConfig.withDefaults(&defaults.moduleConfig)
+
+	if t.NagiosWarning == 0 {
+		t.NagiosWarning = defaults.NagiosWarning
+	}
+	if t.NagiosCritical == 0 {
+		t.NagiosCritical = defaults.NagiosCritical
+	}
+	//targets checked together do not share an archive, each one gets its name as suffix
+	if t.Har == "" && defaults.Har != "" && t.Name != "" {
+		ext := filepath.Ext(defaults.Har)
+		t.Har = strings.TrimSuffix(defaults.Har, ext) + "-" + fileNamePart(t.Name) + ext
+	} else if t.Har == "" {
+		t.Har = defaults.Har
+	}
+	if t.LineProtocol == "" {
+		t.LineProtocol = defaults.LineProtocol
+	}
+	if t.Interval == "" {
+		t.Interval = defaults.Interval
+	}
+	t.RepeatView = t.RepeatView || defaults.RepeatView
+	t.UseInflux = t.UseInflux || defaults.UseInflux
+
+	tags := make(map[string]string)
+	for k, v := range defaults.InfluxTags {
+		tags[k] = v
+	}
+	for k, v := range t.InfluxTags {
+		tags[k] = v
+	}
+	t.InfluxTags = tags
+
+	return t
+}
+
+// A target name usable in a file name, the characters other than letters, digits, dots and dashes are replaced
+func fileNamePart(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Request headers of a module, with its user agent
+func (m *moduleConfig) requestHeaders() map[string]string {
+	headers := make(map[string]string)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	if m.UserAgent != "" {
+		headers["User-Agent"] = m.UserAgent
+	}
+	return headers
+}
+
+// Http client settings of a module, the SNI override applies to the host of mainUrl
+func (m *moduleConfig) clientConfig(mainUrl string, timeout int) *clientConfig {
+	config := &clientConfig{
+		connectTimeout:        m.ConnectTimeout,
+		tlsTimeout:            m.TlsTimeout,
+		responseHeaderTimeout: m.ResponseHeaderTimeout,
+		timeout:               timeout,
+		resolve:               m.Resolve,
+		dnsServer:             m.DnsServer,
+		ipVersion:             m.IpVersion,
+		httpVersion:           m.HttpVersion,
+		proxy:                 proxyConfig{url: m.Proxy, noProxy: m.NoProxy, pac: m.ProxyPac, script: m.pacScript},
+		tls: tlsClientConfig{
+			caFile:         m.CaFile,
+			certFile:       m.CertFile,
+			keyFile:        m.KeyFile,
+			pkcs12File:     m.Pkcs12File,
+			pkcs12Password: m.Pkcs12Password,
+			serverName:     m.Sni,
+			minVersion:     m.TlsMinVersion,
+			maxVersion:     m.TlsMaxVersion,
+			ciphers:        m.TlsCiphers,
+			insecure:       m.Insecure,
+		},
+	}
+	if u, err := url.Parse(mainUrl); err == nil {
+		config.tls.sniHost = u.Hostname()
+	}
+	return config
+}
+
+// Global timeout of a target, nagios checks stop at the critical threshold
+func (t *targetConfig) clientTimeout() int {
+	if useNagios && t.NagiosCritical > 0 {
+		return t.NagiosCritical
+	}
+	return t.Timeout
+}
+
+// Page fetch settings of a target
+func (t *targetConfig) pageConfig() *pageConfig {
+	return &pageConfig{
+		url:                  t.Url,
+		headers:              t.requestHeaders(),
+		keyword:              t.Keyword,
+		assetsAllowedDomains: t.AssetsAllowedDomains,
+		parallel:             t.Parallel,
+		noDedup:              t.NoDedup,
+		assertions:           t.Assert,
+		certWarningDays:      t.CertWarningDays,
+		certCriticalDays:     t.CertCriticalDays,
+		frameDepth:           t.FrameDepth,
+		includePrefetch:      t.IncludePrefetch,
+		maxAssetSize:         t.MaxAssetSize,
+		hashAssets:           t.HashAssets,
+		auditCompression:     t.AuditCompression,
+		auditCache:           t.AuditCache,
+		maxUncacheable:       t.MaxUncacheable,
+		auditSecurity:        t.AuditSecurity,
+		viewport:             t.viewport(),
+	}
+}
+
+// Check a target: fetch its page, the repeat view, then write the sinks
+func runTarget(target *targetConfig, influx *influxConfig, stream func(statType string, stat *downloadStatistic)) *targetResult {
+	result := &targetResult{target: target}
+
+	client, transport, err := newHttpClient(target.clientConfig(target.Url, target.clientTimeout()))
+	if err != nil {
+		result.err = err
+		result.status = NAGIOS_UNKNOWN
+		result.page.err = err
+		result.page.mainUrlStat = downloadStatistic{url: target.Url, err: err}
+		return result
+	}
+	//the client is built for each check, its connections are not reused
+	defer transport.CloseIdleConnections()
+
+	//repeat view needs a browser like cache
+	if target.RepeatView {
+		client.Transport = newHttpCache(transport)
+	}
+
+	config := target.pageConfig()
+	result.page = fetchPage(config, client, stream)
+	if result.page.err != nil {
+		writeSinks(target, influx, &result.page, nil)
+		result.status = NAGIOS_ERROR
+		return result
+	}
+
+	//fetch the page again with a warm cache and new connections
+	if target.RepeatView {
+		transport.CloseIdleConnections()
+		if verbose {
+			fmt.Fprintln(logOutput(), bold_white("Repeat view"), target.Name)
+		}
+		var repeatStream func(statType string, stat *downloadStatistic)
+		if stream != nil {
+			repeatStream = func(statType string, stat *downloadStatistic) {
+				stream("repeat-"+statType, stat)
+			}
+		}
+		p := fetchPage(config, client, repeatStream)
+		result.repeatPage = &p
+	}
+
+	writeSinks(target, influx, &result.page, nil)
+
+	result.status = worseNagiosStatus(
+		nagiosStatus(result.page.gstat.totalResponseTime, target.NagiosWarning, target.NagiosCritical),
+		assertionsStatus(result.page.failures))
+	return result
+}
+
+// Write a page fetch to the har, influxdb and line protocol sinks of a target
+func writeSinks(target *targetConfig, influx *influxConfig, page *pageResult, extraTags map[string]string) {
+	// write the har archive
+	if target.Har != "" {
+		if err := writeHar(target.Har, page.assetsStats, page.failedStats, page.gstat); err != nil {
+			fmt.Fprintln(logOutput(), red("Error:"), "har", err)
+		}
+	}
+
+	// send data to influxdb
+	sink := *influx
+	sink.tags = make(map[string]string)
+	for _, tags := range []map[string]string{influx.tags, target.InfluxTags, extraTags} {
+		for k, v := range tags {
+			sink.tags[k] = v
+		}
+	}
+	if target.Name != "" {
+		sink.tags["target"] = target.Name
+	}
+	if target.UseInflux {
+		if err := sendstatsToInflux(&sink, page); err != nil {
+			fmt.Fprintln(logOutput(), red("Influxdb - error:"), err)
+		}
+	}
+	if target.LineProtocol != "" {
+		if err := writeLineProtocolFile(target.LineProtocol, sink.measurement, page, sink.tags); err != nil {
+			fmt.Fprintln(logOutput(), red("Error:"), "line protocol", err)
+		}
+	}
+}
+
+// Check all the targets, at most maxConcurrent at the same time.
+// stream, if set, is called with each statistic and its target name.
+func runTargets(targets []targetConfig, maxConcurrent int, influx *influxConfig,
+	stream func(target string, statType string, stat *downloadStatistic)) []*targetResult {
+
+	results := make([]*targetResult, len(targets))
+	sem := make(chan struct{}, maxConcurrent)
+	var wg sync.WaitGroup
+
+	for i := range targets {
+		wg.Add(1)
+		go func(target *targetConfig, i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			var targetStream func(statType string, stat *downloadStatistic)
+			if stream != nil {
+				targetStream = func(statType string, stat *downloadStatistic) {
+					stream(target.Name, statType, stat)
+				}
+			}
+			results[i] = runTarget(target, influx, targetStream)
+		}(&targets[i], i)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Nagios status of a page fetch duration
+func nagiosStatus(duration time.Duration, warning int, critical int) int {
+	if critical > 0 && duration >= time.Duration(critical)*time.Millisecond {
+		return NAGIOS_ERROR
+	} else if warning > 0 && duration >= time.Duration(warning)*time.Millisecond {
+		return NAGIOS_WARNING
+	}
+	return NAGIOS_OK
+}
+
+// Nagios status name
+func nagiosStatusName(status int) string {
+	switch status {
+	case NAGIOS_OK:
+		return "OK"
+	case NAGIOS_WARNING:
+		return "WARNING"
+	case NAGIOS_ERROR:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// Worst nagios status: critical, warning, unknown then ok
+func worstNagiosStatus(results []*targetResult) int {
+	worst := NAGIOS_OK
+	for _, r := range results {
+		worst = worseNagiosStatus(worst, r.status)
+	}
+	return worst
+}
+
+// Worse of two nagios statuses
+func worseNagiosStatus(a int, b int) int {
+	rank := map[int]int{NAGIOS_OK: 0, NAGIOS_UNKNOWN: 1, NAGIOS_WARNING: 2, NAGIOS_ERROR: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// Print the nagios line of all the targets, one line per target as long output
+func printTargetsNagios(results []*targetResult) {
+	count := make(map[int]int)
+	var perfdata []string
+	for _, r := range results {
+		count[r.status]++
+		if r.page.err == nil {
+			gstat := r.page.gstat
+			perfdata = append(perfdata,
+				fmt.Sprintf("'%s time'=%.3fms;%d;%d;0", r.target.Name, msec(gstat.totalResponseTime),
+					r.target.NagiosWarning, r.target.NagiosCritical),
+				fmt.Sprintf("'%s size'=%dKB", r.target.Name, gstat.totalResponseSize/1024))
+		}
+	}
+
+	fmt.Printf("Checked %d targets: %d OK, %d WARNING, %d CRITICAL, %d UNKNOWN.|%s\n",
+		len(results), count[NAGIOS_OK], count[NAGIOS_WARNING], count[NAGIOS_ERROR], count[NAGIOS_UNKNOWN],
+		strings.Join(perfdata, " "))
+
+	for _, r := range results {
+		if r.page.err != nil {
+			fmt.Printf("%s: %s %v\n", r.target.Name, nagiosStatusName(r.status), r.page.err)
+			continue
+		}
+		gstat := r.page.gstat
+		failures := ""
+		if len(r.page.failures) > 0 {
+			failures = " Assertions failed: " + formatAssertFailures(r.page.failures) + "."
+		}
+		fmt.Printf("%s: %s downloaded %vKB in %d/%d files in %v.%s\n", r.target.Name, nagiosStatusName(r.status),
+			gstat.totalResponseSize/1024, len(r.page.assetsStats), len(r.page.assets), gstat.totalResponseTime, failures)
+	}
+}
+
+// Print the text summary of all the targets
+func printTargetsSummary(results []*targetResult) {
+	for i, r := range results {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(bold_white(r.target.Name), r.target.Url)
+		if r.page.err != nil {
+			fmt.Println(red("Fatal:"), r.page.err)
+			continue
+		}
+		printPageSummary(&r.page)
+		if r.repeatPage != nil {
+			fmt.Println(bold_white("Repeat view:"))
+			printPageSummary(r.repeatPage)
+		}
+	}
+}
+
+// Targets of the configuration file with their defaults filled
+func fileTargets(c *cli.Context, file *fileConfig) []targetConfig {
+	flagDefaults := flagsTargetConfig(c)
+	defaults := file.Defaults.withDefaults(&flagDefaults)
+
+	targets := make([]targetConfig, len(file.Targets))
+	for i, target := range file.Targets {
+		targets[i] = target.withDefaults(&defaults)
+	}
+	return targets
+}
+
+// Check the targets of the configuration file and print the combined report
+func checkTargets(c *cli.Context, file *fileConfig) {
+	targets := fileTargets(c, file)
+
+	influx, err := flagsInfluxConfig(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(NAGIOS_UNKNOWN)
+	}
+
+	//stream the statistics in ndjson mode
+	var stream func(target string, statType string, stat *downloadStatistic)
+	if outputFormat == outputNdjson && !useNagios {
+		var mu sync.Mutex
+		stream = func(target string, statType string, stat *downloadStatistic) {
+			mu.Lock()
+			defer mu.Unlock()
+			writeNdjsonStat(os.Stdout, target, statType, stat)
+		}
+	}
+
+	results := runTargets(targets, file.MaxConcurrentTargets, influx, stream)
+
+	failed := false
+	for _, r := range results {
+		failed = failed || r.page.err != nil || assertionsStatus(r.page.failures) == NAGIOS_ERROR
+	}
+
+	if useNagios {
+		printTargetsNagios(results)
+		os.Exit(worstNagiosStatus(results))
+	} else if !textOutput() {
+		writeTargetsReport(os.Stdout, results)
+	} else {
+		printTargetsSummary(results)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
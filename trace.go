@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// phaseTimer records the timing of each phase of a request
+// using the net/http/httptrace hooks
+type phaseTimer struct {
+	mu sync.Mutex
+
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+
+	dnsTime     time.Duration
+	connectTime time.Duration
+	tlsTime     time.Duration
+	sendTime    time.Duration
+	ttfb        time.Duration
+	connReused  bool
+	remoteAddr  string
+	connection  string
+
+	//the connect phase goes to the proxy, until the tunnel is ready
+	proxy     string
+	proxyTime time.Duration
+
+	dns *dnsInfo
+}
+
+// Record the DNS resolution of the request host
+func (p *phaseTimer) setDns(info *dnsInfo) {
+	p.mu.Lock()
+	p.dns = info
+	p.mu.Unlock()
+}
+
+// Context key of the timer of a request, for the proxy selection
+type phaseTimerKey struct{}
+
+// Record the proxy of the request
+func (p *phaseTimer) setProxy(proxy string) {
+	p.mu.Lock()
+	p.proxy = proxy
+	p.mu.Unlock()
+}
+
+// The proxy tunnel is ready once the origin TLS handshake starts
+// or the connection is handed to the request
+func (p *phaseTimer) proxyReady() {
+	if p.proxy != "" && p.proxyTime == 0 && !p.connectStart.IsZero() {
+		p.proxyTime = time.Since(p.connectStart)
+	}
+}
+
+// Attach the timer to the request context
+func (p *phaseTimer) trace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			p.mu.Lock()
+			p.dnsStart = time.Now()
+			p.mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			p.mu.Lock()
+			p.dnsTime += time.Since(p.dnsStart)
+			//the DNS server answers are recorded by the resolver
+			if p.dns == nil && info.Err == nil {
+				p.dns = &dnsInfo{server: "system"}
+				for _, addr := range info.Addrs {
+					p.dns.addrs = append(p.dns.addrs, addr.String())
+				}
+			}
+			p.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			p.mu.Lock()
+			p.connectStart = time.Now()
+			p.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			p.mu.Lock()
+			if p.proxy == "" {
+				p.connectTime += time.Since(p.connectStart)
+			}
+			p.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			p.mu.Lock()
+			p.tlsStart = time.Now()
+			p.proxyReady()
+			p.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			p.mu.Lock()
+			p.tlsTime += time.Since(p.tlsStart)
+			p.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mu.Lock()
+			p.gotConn = time.Now()
+			p.proxyReady()
+			p.connReused = info.Reused
+			p.remoteAddr = info.Conn.RemoteAddr().String()
+			//the local address tells the connections apart
+			p.connection = info.Conn.LocalAddr().String() + "-" + p.remoteAddr
+			p.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			p.mu.Lock()
+			p.wroteRequest = time.Now()
+			p.sendTime += p.wroteRequest.Sub(p.gotConn)
+			p.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			p.mu.Lock()
+			p.firstByte = time.Now()
+			p.ttfb += p.firstByte.Sub(p.wroteRequest)
+			p.mu.Unlock()
+		},
+	}
+	ctx := context.WithValue(req.Context(), phaseTimerKey{}, p)
+	return req.WithContext(httptrace.WithClientTrace(ctx, trace))
+}
+
+// Copy the recorded phases into the statistic,
+// the download phase ends now
+func (p *phaseTimer) fill(stat *downloadStatistic) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stat.dnsTime = p.dnsTime
+	stat.connectTime = p.connectTime
+	stat.tlsTime = p.tlsTime
+	stat.sendTime = p.sendTime
+	stat.ttfb = p.ttfb
+	stat.connReused = p.connReused
+	stat.remoteAddr = p.remoteAddr
+	stat.connection = p.connection
+	stat.proxy = p.proxy
+	stat.proxyTime = p.proxyTime
+	stat.dns = p.dns
+	if !p.firstByte.IsZero() {
+		stat.downloadTime = time.Since(p.firstByte)
+	}
+}
+
+// Protocols and connections used by the requests of a page
+type connectionUsage struct {
+	protocols     map[string]int // requests by protocol, like HTTP/2.0
+	connections   int
+	maxConcurrent int // most requests in flight on one connection
+}
+
+// Count the protocols and connections of the network requests,
+// the cache hits have no connection
+func pageConnectionUsage(stats []downloadStatistic) connectionUsage {
+	usage := connectionUsage{protocols: make(map[string]int)}
+
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := make(map[string][]event)
+	for _, stat := range stats {
+		if stat.connection == "" {
+			continue
+		}
+		usage.protocols[stat.proto]++
+		events[stat.connection] = append(events[stat.connection],
+			event{stat.startTime, 1}, event{stat.startTime.Add(stat.responseTime), -1})
+	}
+
+	usage.connections = len(events)
+	for _, connEvents := range events {
+		//ends first on ties, back to back requests are not concurrent
+		sort.Slice(connEvents, func(i, j int) bool {
+			if connEvents[i].at.Equal(connEvents[j].at) {
+				return connEvents[i].delta < connEvents[j].delta
+			}
+			return connEvents[i].at.Before(connEvents[j].at)
+		})
+		inFlight := 0
+		for _, e := range connEvents {
+			inFlight += e.delta
+			if inFlight > usage.maxConcurrent {
+				usage.maxConcurrent = inFlight
+			}
+		}
+	}
+	return usage
+}
+
+// Format the requests by protocol, like "HTTP/1.1 x2, HTTP/2.0 x81"
+func (usage *connectionUsage) formatProtocols() string {
+	var protocols []string
+	for proto := range usage.protocols {
+		protocols = append(protocols, proto)
+	}
+	sort.Strings(protocols)
+
+	var parts []string
+	for _, proto := range protocols {
+		parts = append(parts, fmt.Sprintf("%s x%d", proto, usage.protocols[proto]))
+	}
+	return strings.Join(parts, ", ")
+}